@@ -2,33 +2,101 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/audit"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/control"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/metrics"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/netutil"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/ocmobile"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/tailscale"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/tlsutil"
 )
 
 type Options struct {
 	ConfigDir string
 	Config    config.Config
-	Token     string
 	Tailscale tailscale.Client
+	// OpenCodeLog receives OpenCode's output, each line prefixed with a timestamp. If nil, the
+	// output goes to the agent's own stdout and stderr.
+	OpenCodeLog io.Writer
+	// GatewayLog receives the gateway's diagnostics. If nil, they go to stderr.
+	GatewayLog io.Writer
+	// AccessLog receives the gateway's access log. If nil, requests are not logged.
+	AccessLog io.Writer
 }
 
+const (
+	// statusHeartbeat is how often the running agent refreshes status.json. A file that has not
+	// been updated for much longer than this was left behind by an agent that is gone.
+	statusHeartbeat = 10 * time.Second
+
+	// maxRecentErrors is how many errors status.json keeps.
+	maxRecentErrors = 20
+)
+
 type Status struct {
 	UpdatedAtMs int64  `json:"updatedAtMs"`
 	LastError   string `json:"lastError"`
+	// RecentErrors holds the latest errors, oldest first. It survives agent restarts.
+	RecentErrors []StatusError    `json:"recentErrors,omitempty"`
+	Gateway      GatewayStatus    `json:"gateway"`
+	Tailscale    *TailscaleStatus `json:"tailscale,omitempty"`
+	OpenCode     OpenCodeStatus   `json:"opencode"`
+}
+
+// StatusError is an error recorded in status.json.
+type StatusError struct {
+	AtMs    int64  `json:"atMs"`
+	Message string `json:"message"`
+}
+
+// GatewayStatus describes where the gateway can be reached.
+type GatewayStatus struct {
+	// ListenAddrs are the addresses the gateway accepts connections on. A wildcard listener is
+	// expanded to this machine's LAN addresses.
+	ListenAddrs []string `json:"listenAddrs,omitempty"`
+	// PairingBaseURL is the URL a phone paired now would be given.
+	PairingBaseURL string `json:"pairingBaseUrl,omitempty"`
+	// Clients is the number of connected event streams.
+	Clients int `json:"clients"`
+}
+
+// TailscaleStatus is what the agent found when it set up Tailscale mode.
+type TailscaleStatus struct {
+	LoggedIn bool   `json:"loggedIn"`
+	DNSName  string `json:"dnsName,omitempty"`
+	IPv4     string `json:"ipv4,omitempty"`
+	// Serve is true if Tailscale Serve proxies the gateway.
+	Serve bool   `json:"serve"`
+	Error string `json:"error,omitempty"`
+}
+
+// OpenCodeStatus is the supervisor's view of the OpenCode process.
+type OpenCodeStatus struct {
+	State string `json:"state,omitempty"`
+	// Ready is true once OpenCode answered the readiness probe, until a liveness probe fails
+	// or the process exits.
+	Ready          bool  `json:"ready"`
+	ProbeLatencyMs int64 `json:"probeLatencyMs,omitempty"`
+	LastProbeAtMs  int64 `json:"lastProbeAtMs,omitempty"`
+	PID            int   `json:"pid,omitempty"`
+	StartedAtMs    int64 `json:"startedAtMs,omitempty"`
+	Restarts       int   `json:"restarts"`
+	// LastExitCode is how the previous process ended; -1 if it was killed by a signal.
+	LastExitCode *int `json:"lastExitCode,omitempty"`
 }
 
 var cgnatIPv4s = netutil.CGNATIPv4s
@@ -49,26 +117,131 @@ func ReadStatus(configDir string) (Status, bool) {
 	return s, true
 }
 
-func writeStatus(configDir string, lastErr string) {
+// statusMu serializes read-modify-write updates of status.json within the agent.
+var statusMu sync.Mutex
+
+// updateStatus applies fn to the recorded status and writes it back.
+func updateStatus(configDir string, fn func(*Status)) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	s, _ := ReadStatus(configDir)
+	fn(&s)
+	s.UpdatedAtMs = time.Now().UnixMilli()
+
 	_ = os.MkdirAll(configDir, 0o700)
-	s := Status{
-		UpdatedAtMs: time.Now().UnixMilli(),
-		LastError:   lastErr,
-	}
 	raw, _ := json.MarshalIndent(s, "", "  ")
-	_ = os.WriteFile(statusPath(configDir), raw, 0o600)
+	// Write and rename so readers such as `oc-pocket status` never see a partial file.
+	tmp := statusPath(configDir) + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return
+	}
+	_ = os.Rename(tmp, statusPath(configDir))
+}
+
+// writeStatus records lastErr as the current error and, if it is not empty, in the recent
+// errors.
+func writeStatus(configDir string, lastErr string) {
+	updateStatus(configDir, func(s *Status) {
+		s.LastError = lastErr
+		if lastErr == "" {
+			return
+		}
+		s.RecentErrors = append(s.RecentErrors, StatusError{AtMs: time.Now().UnixMilli(), Message: lastErr})
+		if n := len(s.RecentErrors); n > maxRecentErrors {
+			s.RecentErrors = append([]StatusError(nil), s.RecentErrors[n-maxRecentErrors:]...)
+		}
+	})
+}
+
+// heartbeat refreshes the parts of status.json that change without an event of their own until
+// ctx is done.
+func heartbeat(ctx context.Context, configDir string, gw *gateway.Server, opencode *openCodeSupervisor) {
+	ticker := time.NewTicker(statusHeartbeat)
+	defer ticker.Stop()
+	for {
+		st := gatewayStatus(gw)
+		updateStatus(configDir, func(s *Status) {
+			st.PairingBaseURL = pairingBaseURL(st.ListenAddrs, s.Tailscale, gw.BaseURL())
+			s.Gateway = st
+		})
+		opencode.syncStatus()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func gatewayStatus(gw *gateway.Server) GatewayStatus {
+	st := GatewayStatus{Clients: gw.EventClients()}
+	addr := gw.Addr()
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			for _, lan := range netutil.LocalIPv4s() {
+				st.ListenAddrs = append(st.ListenAddrs, net.JoinHostPort(lan, port))
+			}
+		}
+	}
+	if len(st.ListenAddrs) == 0 && addr != "" {
+		st.ListenAddrs = []string{addr}
+	}
+	return st
+}
+
+// pairingBaseURL mirrors the URL `oc-pocket setup` prints: the Tailscale Serve URL when Serve
+// proxies the gateway, otherwise the first address the gateway listens on.
+func pairingBaseURL(listenAddrs []string, ts *TailscaleStatus, gatewayURL string) string {
+	if ts != nil && ts.Serve && ts.DNSName != "" {
+		return "https://" + ts.DNSName
+	}
+	if len(listenAddrs) == 0 {
+		return ""
+	}
+	scheme := "http"
+	if strings.HasPrefix(gatewayURL, "https://") {
+		scheme = "https"
+	}
+	return scheme + "://" + listenAddrs[0]
+}
+
+// recordAudit returns the gateway's audit callback, appending to log.
+func recordAudit(log *audit.Log) func(gateway.AuditEvent) {
+	return func(ev gateway.AuditEvent) {
+		_, err := log.Append(audit.Entry{
+			AtMs:       ev.Time.UnixMilli(),
+			Device:     ev.Device,
+			Action:     ev.Action,
+			Method:     ev.Method,
+			Path:       ev.Path,
+			Session:    ev.Session,
+			Directory:  ev.Directory,
+			BodySHA256: ev.BodySHA256,
+			BodyBytes:  ev.BodyBytes,
+			Status:     ev.Status,
+			Error:      ev.Error,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "oc-pocket: audit: "+err.Error())
+		}
+	}
+}
+
+// recordTailscale stores what decideGatewayListenAddr found about Tailscale.
+func recordTailscale(configDir string, ts TailscaleStatus) {
+	updateStatus(configDir, func(s *Status) { s.Tailscale = &ts })
 }
 
 func Run(ctx context.Context, opts Options) error {
+	startedAt := time.Now()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	if opts.ConfigDir == "" {
 		return errors.New("ConfigDir is required")
 	}
-	if strings.TrimSpace(opts.Token) == "" {
-		return errors.New("Token is required")
-	}
 	if opts.Config.GatewayPort == 0 || opts.Config.OpenCodePort == 0 {
 		return errors.New("invalid config ports")
 	}
@@ -79,25 +252,117 @@ func Run(ctx context.Context, opts Options) error {
 		return errors.New("DefaultDirectory is required")
 	}
 
-	writeStatus(opts.ConfigDir, "")
+	// Start from a clean status; only the error history of the previous run still applies.
+	updateStatus(opts.ConfigDir, func(s *Status) { *s = Status{RecentErrors: s.RecentErrors} })
+
+	registry := config.DeviceRegistry{BaseDir: opts.ConfigDir}
+	if _, err := registry.MigrateLegacyToken(time.Now()); err != nil {
+		writeStatus(opts.ConfigDir, "devices: "+err.Error())
+		return err
+	}
 
 	upstream := fmt.Sprintf("http://127.0.0.1:%d", opts.Config.OpenCodePort)
-	listenAddr := decideGatewayListenAddr(ctx, opts.Config, opts.Tailscale, opts.ConfigDir)
+	listenAddr, serve := decideGatewayListenAddr(ctx, opts.Config, opts.Tailscale, opts.ConfigDir)
+
+	var tlsConfig *tls.Config
+	if opts.Config.TLS && !isLoopbackAddr(listenAddr) {
+		ips, dnsNames := tlsutil.LocalNames()
+		bundle, err := tlsutil.Ensure(tlsutil.Dir(opts.ConfigDir), ips, dnsNames, time.Now())
+		if err != nil {
+			writeStatus(opts.ConfigDir, "tls: "+err.Error())
+			return err
+		}
+		tlsConfig = bundle.ServerConfig()
+	}
+
+	auditLog, err := audit.Open(audit.Path(opts.ConfigDir))
+	if err != nil {
+		writeStatus(opts.ConfigDir, "audit: "+err.Error())
+		return err
+	}
+	defer func() { _ = auditLog.Close() }()
+
+	opencode := newOpenCodeSupervisor(opts.ConfigDir, opts.Config.OpenCodePath, opts.Config.OpenCodePort, opts.Config.DefaultDirectory)
+	opencode.logFile = opts.OpenCodeLog
+	if grace := opts.Config.ShutdownGraceSeconds; grace != 0 {
+		opencode.grace = max(time.Duration(grace)*time.Second, 0)
+	}
+	var reg *metrics.Registry
+	if MetricsAddr(opts.Config) != "" {
+		reg = metrics.NewRegistry()
+		registerMetrics(reg, startedAt, opencode)
+	}
+	api := &controlAPI{configDir: opts.ConfigDir, opencode: opencode}
+	adminHandler := api.handler()
+	auth := newRegistryAuth(registry)
+	// Let last-seen writes started by the last requests finish.
+	defer auth.touches.Wait()
 
 	gw, err := gateway.New(gateway.Options{
 		ListenAddr: listenAddr,
 		Upstream:   upstream,
-		Token:      opts.Token,
+		Auth:       auth,
+		TLSConfig:  tlsConfig,
+		Version:    ocmobile.Version,
+		HostName:   ocmobile.DefaultDeviceName(),
+		StartedAt:  startedAt,
+		Admin:      adminHandler,
+		Log:        opts.GatewayLog,
+		AccessLog:  opts.AccessLog,
+		Audit:      recordAudit(auditLog),
+		Metrics:    reg,
+
+		UpstreamReady:  opencode.Ready,
+		UpstreamStatus: opencode.Status,
+		AwaitUpstream:  opencode.AwaitReady,
+		HoldTimeout:    time.Duration(opts.Config.HoldTimeoutSeconds) * time.Second,
+
+		SSEHeartbeat: time.Duration(opts.Config.SSEHeartbeatSeconds) * time.Second,
+
+		// Tailscale Serve reaches the gateway from loopback and names the client in
+		// X-Forwarded-For.
+		TrustForwardedFor: serve,
 	})
 	if err != nil {
 		writeStatus(opts.ConfigDir, "gateway: "+err.Error())
 		return err
 	}
 	defer func() { _ = gw.Close() }()
+	api.gw = gw
 
 	var wg sync.WaitGroup
 	errCh := make(chan error, 2)
 
+	// The control socket is a convenience for CLI commands; the agent keeps serving without it.
+	socketPath := control.SocketPath(opts.ConfigDir)
+	if ln, err := control.Listen(socketPath); err != nil {
+		fmt.Fprintln(os.Stderr, "oc-pocket: control socket unavailable: "+err.Error())
+	} else {
+		defer func() { _ = os.Remove(socketPath) }()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := control.Serve(ctx, ln, adminHandler); err != nil {
+				fmt.Fprintln(os.Stderr, "oc-pocket: control socket: "+err.Error())
+			}
+		}()
+	}
+
+	// Like the control socket, metrics are optional; a taken port does not stop the agent.
+	if addr := MetricsAddr(opts.Config); addr != "" {
+		if ln, err := net.Listen("tcp", addr); err != nil {
+			writeStatus(opts.ConfigDir, "metrics: "+err.Error())
+		} else {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := control.Serve(ctx, ln, metricsHandler(reg)); err != nil {
+					fmt.Fprintln(os.Stderr, "oc-pocket: metrics: "+err.Error())
+				}
+			}()
+		}
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -109,7 +374,13 @@ func Run(ctx context.Context, opts Options) error {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := superviseOpenCode(ctx, opts.ConfigDir, opts.Config.OpenCodePath, opts.Config.OpenCodePort, opts.Config.DefaultDirectory); err != nil {
+		heartbeat(ctx, opts.ConfigDir, gw, opencode)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := opencode.run(ctx); err != nil {
 			errCh <- err
 		}
 	}()
@@ -126,15 +397,16 @@ func Run(ctx context.Context, opts Options) error {
 	}
 }
 
-func decideGatewayListenAddr(ctx context.Context, cfg config.Config, ts tailscale.Client, configDir string) string {
+func decideGatewayListenAddr(ctx context.Context, cfg config.Config, ts tailscale.Client, configDir string) (addr string, serve bool) {
 	switch cfg.Mode {
 	case config.ModeLAN:
-		return fmt.Sprintf("0.0.0.0:%d", cfg.GatewayPort)
+		return fmt.Sprintf("0.0.0.0:%d", cfg.GatewayPort), false
 	case config.ModeLocalhost:
-		return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort)
+		return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort), false
 	case config.ModeTailscale:
 		st, err := ts.GetStatus(ctx)
 		if err != nil {
+			recordTailscale(configDir, TailscaleStatus{LoggedIn: st.LoggedIn, Error: err.Error()})
 			// In LaunchAgent environments, the Tailscale macOS bundle binary can fail to emit JSON even
 			// when Tailscale is running. In that specific case, fall back to a best-effort interface
 			// scan so iPhone can still reach the gateway via the tailnet IP.
@@ -142,18 +414,22 @@ func decideGatewayListenAddr(ctx context.Context, cfg config.Config, ts tailscal
 				if ips := cgnatIPv4s(); len(ips) > 0 {
 					writeStatus(configDir, fmt.Sprintf("tailscale: status unreadable; binding gateway to %s", ips[0]))
 					fmt.Fprintln(os.Stderr, "oc-pocket: tailscale status unreadable; binding gateway to "+ips[0])
-					return fmt.Sprintf("%s:%d", ips[0], cfg.GatewayPort)
+					return fmt.Sprintf("%s:%d", ips[0], cfg.GatewayPort), false
 				}
 			}
 			writeStatus(configDir, "tailscale: "+err.Error())
-			return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort)
+			return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort), false
 		}
+		recorded := TailscaleStatus{LoggedIn: st.LoggedIn, DNSName: st.DNSName, IPv4: st.IPv4}
 		if st.DNSName != "" {
 			configured, _ := ts.TryConfigureServe(ctx, cfg.GatewayPort)
+			recorded.Serve = configured
+			recordTailscale(configDir, recorded)
 			if configured {
-				return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort)
+				return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort), true
 			}
 		} else {
+			recordTailscale(configDir, recorded)
 			writeStatus(configDir, "tailscale: DNS name unavailable (MagicDNS may be disabled); binding to Tailscale IPv4 instead of Serve URL")
 		}
 		ipv4 := st.IPv4
@@ -163,53 +439,24 @@ func decideGatewayListenAddr(ctx context.Context, cfg config.Config, ts tailscal
 			}
 		}
 		if ipv4 != "" {
-			return fmt.Sprintf("%s:%d", ipv4, cfg.GatewayPort)
+			return fmt.Sprintf("%s:%d", ipv4, cfg.GatewayPort), false
 		}
 		writeStatus(configDir, "tailscale: could not determine IPv4 for fallback")
-		return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort)
+		return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort), false
 	default:
-		return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort)
+		return fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort), false
 	}
 }
 
-func superviseOpenCode(ctx context.Context, configDir string, opencodePath string, port int, defaultDirectory string) error {
-	backoff := 500 * time.Millisecond
-	for {
-		if ctx.Err() != nil {
-			return nil
-		}
-
-		cmd := exec.Command(opencodePath, "serve", "--hostname", "127.0.0.1", "--port", strconv.Itoa(port))
-		cmd.Dir = defaultDirectory
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = os.Environ()
-
-		if err := cmd.Start(); err != nil {
-			writeStatus(configDir, "opencode start: "+err.Error())
-			return err
-		}
-
-		waitCh := make(chan error, 1)
-		go func() { waitCh <- cmd.Wait() }()
-
-		select {
-		case <-ctx.Done():
-			_ = cmd.Process.Kill()
-			<-waitCh
-			return nil
-		case err := <-waitCh:
-			// Restart on unexpected exit.
-			if ctx.Err() != nil {
-				return nil
-			}
-			writeStatus(configDir, "opencode exited: "+exitErrorString(err))
-			time.Sleep(backoff)
-			if backoff < 10*time.Second {
-				backoff *= 2
-			}
-		}
+// isLoopbackAddr reports whether a listen address is only reachable from this machine, e.g.
+// because Tailscale Serve terminates TLS in front of it.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func exitErrorString(err error) string {
@@ -2,8 +2,10 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
@@ -33,7 +35,7 @@ func TestDecideGatewayListenAddr_Tailscale_StatusError_UsesCGNATFallback(t *test
 	}}
 
 	dir := t.TempDir()
-	got := decideGatewayListenAddr(context.Background(), cfg, ts, dir)
+	got, _ := decideGatewayListenAddr(context.Background(), cfg, ts, dir)
 	if got != "100.64.0.1:4096" {
 		t.Fatalf("listen addr: got=%q want=%q", got, "100.64.0.1:4096")
 	}
@@ -41,6 +43,10 @@ func TestDecideGatewayListenAddr_Tailscale_StatusError_UsesCGNATFallback(t *test
 	if _, err := os.Stat(filepath.Join(dir, "status.json")); err != nil {
 		t.Fatalf("expected status.json to exist: %v", err)
 	}
+	st, _ := ReadStatus(dir)
+	if st.Tailscale == nil || st.Tailscale.Error == "" || st.Tailscale.Serve {
+		t.Fatalf("tailscale status: got=%+v", st.Tailscale)
+	}
 }
 
 func TestDecideGatewayListenAddr_Tailscale_StatusError_NoFallback_WritesStatusAndUsesLoopback(t *testing.T) {
@@ -56,7 +62,7 @@ func TestDecideGatewayListenAddr_Tailscale_StatusError_NoFallback_WritesStatusAn
 	}}
 
 	dir := t.TempDir()
-	got := decideGatewayListenAddr(context.Background(), cfg, ts, dir)
+	got, _ := decideGatewayListenAddr(context.Background(), cfg, ts, dir)
 	if got != "127.0.0.1:4096" {
 		t.Fatalf("listen addr: got=%q want=%q", got, "127.0.0.1:4096")
 	}
@@ -79,7 +85,7 @@ func TestDecideGatewayListenAddr_Tailscale_NotLoggedIn_DoesNotUseCGNATFallback(t
 	}}
 
 	dir := t.TempDir()
-	got := decideGatewayListenAddr(context.Background(), cfg, ts, dir)
+	got, _ := decideGatewayListenAddr(context.Background(), cfg, ts, dir)
 	if got != "127.0.0.1:4096" {
 		t.Fatalf("listen addr: got=%q want=%q", got, "127.0.0.1:4096")
 	}
@@ -87,3 +93,51 @@ func TestDecideGatewayListenAddr_Tailscale_NotLoggedIn_DoesNotUseCGNATFallback(t
 		t.Fatalf("expected status.json to exist: %v", err)
 	}
 }
+
+func TestDecideGatewayListenAddr_Tailscale_Serve_RecordsServeState(t *testing.T) {
+	cfg := config.Config{Mode: config.ModeTailscale, GatewayPort: 4096}
+	ts := tailscale.Client{Binary: "tailscale", Runner: fakeRunner{
+		run: func(_ string, args ...string) (string, string, int, error) {
+			switch strings.Join(args, " ") {
+			case "status --json":
+				return `{"BackendState":"Running","Self":{"DNSName":"mac.tail1234.ts.net.","TailscaleIPs":["100.64.0.1"]}}`, "", 0, nil
+			case "serve --help":
+				return "usage: tailscale serve [--bg] <target>", "", 0, nil
+			}
+			return "", "", 0, nil
+		},
+	}}
+
+	dir := t.TempDir()
+	got, serve := decideGatewayListenAddr(context.Background(), cfg, ts, dir)
+	if got != "127.0.0.1:4096" || !serve {
+		t.Fatalf("listen addr: got=%q serve=%v want=%q serve=true", got, serve, "127.0.0.1:4096")
+	}
+	st, _ := ReadStatus(dir)
+	want := TailscaleStatus{LoggedIn: true, DNSName: "mac.tail1234.ts.net", IPv4: "100.64.0.1", Serve: true}
+	if st.Tailscale == nil || *st.Tailscale != want {
+		t.Fatalf("tailscale status: got=%+v want=%+v", st.Tailscale, want)
+	}
+	if url := pairingBaseURL([]string{got}, st.Tailscale, "http://"+got); url != "https://mac.tail1234.ts.net" {
+		t.Fatalf("pairing base URL: got=%q", url)
+	}
+}
+
+func TestWriteStatus_KeepsRecentErrors(t *testing.T) {
+	dir := t.TempDir()
+	for i := range maxRecentErrors + 5 {
+		writeStatus(dir, fmt.Sprintf("error %d", i))
+	}
+	writeStatus(dir, "")
+
+	st, _ := ReadStatus(dir)
+	if st.LastError != "" {
+		t.Fatalf("last error: got=%q want empty", st.LastError)
+	}
+	if len(st.RecentErrors) != maxRecentErrors {
+		t.Fatalf("recent errors: got=%d want=%d", len(st.RecentErrors), maxRecentErrors)
+	}
+	if first, last := st.RecentErrors[0], st.RecentErrors[maxRecentErrors-1]; first.Message != "error 5" || last.Message != fmt.Sprintf("error %d", maxRecentErrors+4) || last.AtMs == 0 {
+		t.Fatalf("recent errors: first=%+v last=%+v", first, last)
+	}
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+// lastSeenInterval bounds how often a device's last-seen time is written back to the registry.
+const lastSeenInterval = time.Minute
+
+// registryAuth authenticates gateway requests against the device registry.
+//
+// The registry is re-read whenever devices.json changes on disk, so `oc-pocket devices revoke`
+// takes effect without restarting the agent.
+type registryAuth struct {
+	registry config.DeviceRegistry
+	now      func() time.Time
+
+	mu sync.Mutex
+	// info describes the devices.json that devices was read from.
+	info     os.FileInfo
+	devices  []config.Device
+	lastSeen map[string]time.Time
+
+	// touches tracks last-seen writes still in flight.
+	touches sync.WaitGroup
+}
+
+func newRegistryAuth(registry config.DeviceRegistry) *registryAuth {
+	return &registryAuth{
+		registry: registry,
+		now:      time.Now,
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+func (a *registryAuth) Authenticate(token string) (gateway.Principal, error) {
+	p, seen, err := a.authenticate(token)
+	if !seen.IsZero() {
+		// Writing devices.json takes its lock and fsyncs; don't make other requests wait on it.
+		a.touches.Add(1)
+		go func() {
+			defer a.touches.Done()
+			a.touch(p.Device, seen)
+		}()
+	}
+	return p, err
+}
+
+// authenticate looks the token up. seen is the last-seen time to write back for the device,
+// or zero if it was written recently enough.
+func (a *registryAuth) authenticate(token string) (p gateway.Principal, seen time.Time, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.reloadLocked(); err != nil {
+		return gateway.Principal{}, time.Time{}, err
+	}
+
+	for _, d := range a.devices {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(d.Token)) != 1 {
+			continue
+		}
+		if d.Revoked() {
+			return gateway.Principal{}, time.Time{}, gateway.ErrTokenRevoked
+		}
+		return gateway.Principal{Device: d.Name, Scope: d.EffectiveScope()}, a.touchDueLocked(d.Name), nil
+	}
+	return gateway.Principal{}, time.Time{}, gateway.ErrInvalidToken
+}
+
+func (a *registryAuth) reloadLocked() error {
+	info, err := os.Stat(a.registry.Path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			a.devices = nil
+			a.info = nil
+			return nil
+		}
+		return err
+	}
+	// Writers replace devices.json by renaming a new file over it, so a new inode catches a
+	// rewrite even when the size and modification time come out the same.
+	if a.devices != nil && a.info != nil && os.SameFile(a.info, info) &&
+		info.ModTime().Equal(a.info.ModTime()) && info.Size() == a.info.Size() {
+		return nil
+	}
+	devices, err := a.registry.List()
+	if err != nil {
+		return err
+	}
+	if devices == nil {
+		devices = []config.Device{}
+	}
+	a.devices = devices
+	a.info = info
+	return nil
+}
+
+func (a *registryAuth) touchDueLocked(name string) time.Time {
+	now := a.now()
+	if prev, ok := a.lastSeen[name]; ok && now.Sub(prev) < lastSeenInterval {
+		return time.Time{}
+	}
+	a.lastSeen[name] = now
+	return now
+}
+
+func (a *registryAuth) touch(name string, now time.Time) {
+	if err := a.registry.Touch(name, now); err != nil {
+		fmt.Fprintln(os.Stderr, "oc-pocket: record device last-seen: "+err.Error())
+	}
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+func TestRegistryAuth_RevokeTakesEffectWithoutRestart(t *testing.T) {
+	registry := config.DeviceRegistry{BaseDir: t.TempDir()}
+	if _, err := registry.Add("iphone", "tok_phone", config.ScopeChat, time.Now()); err != nil {
+		t.Fatalf("Add(iphone) error: %v", err)
+	}
+	if _, err := registry.Add("ipad", "tok_pad", config.ScopeRead, time.Now()); err != nil {
+		t.Fatalf("Add(ipad) error: %v", err)
+	}
+
+	auth := newRegistryAuth(registry)
+	t.Cleanup(auth.touches.Wait)
+	p, err := auth.Authenticate("tok_phone")
+	if err != nil {
+		t.Fatalf("Authenticate(phone) error: %v", err)
+	}
+	if p.Device != "iphone" {
+		t.Fatalf("device: got=%q want=%q", p.Device, "iphone")
+	}
+	auth.touches.Wait()
+
+	d, err := registry.Get("iphone")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if d.LastSeenAtMs == 0 {
+		t.Fatalf("expected last-seen to be recorded")
+	}
+
+	if err := registry.Revoke("iphone", time.Now()); err != nil {
+		t.Fatalf("Revoke() error: %v", err)
+	}
+	if _, err := auth.Authenticate("tok_phone"); !errors.Is(err, gateway.ErrTokenRevoked) {
+		t.Fatalf("Authenticate(revoked) error: got=%v want=%v", err, gateway.ErrTokenRevoked)
+	}
+	if _, err := auth.Authenticate("tok_pad"); err != nil {
+		t.Fatalf("Authenticate(other device) error: %v", err)
+	}
+}
+
+func TestRegistryAuth_NoticesRewriteWithSameSizeAndModTime(t *testing.T) {
+	registry := config.DeviceRegistry{BaseDir: t.TempDir()}
+	if _, err := registry.Add("iphone", "tok_old", config.ScopeChat, time.Now()); err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+
+	auth := newRegistryAuth(registry)
+	t.Cleanup(auth.touches.Wait)
+	auth.lastSeen["iphone"] = time.Now() // keep last-seen writes out of the way
+	if _, err := auth.Authenticate("tok_old"); err != nil {
+		t.Fatalf("Authenticate(old) error: %v", err)
+	}
+
+	before, err := os.Stat(registry.Path())
+	if err != nil {
+		t.Fatalf("Stat() error: %v", err)
+	}
+	if err := registry.RotateToken("iphone", "tok_new"); err != nil {
+		t.Fatalf("RotateToken() error: %v", err)
+	}
+	if err := os.Chtimes(registry.Path(), before.ModTime(), before.ModTime()); err != nil {
+		t.Fatalf("Chtimes() error: %v", err)
+	}
+	after, err := os.Stat(registry.Path())
+	if err != nil {
+		t.Fatalf("Stat() error: %v", err)
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("test setup: expected same size and mtime, got %d/%v and %d/%v", before.Size(), before.ModTime(), after.Size(), after.ModTime())
+	}
+
+	if _, err := auth.Authenticate("tok_old"); !errors.Is(err, gateway.ErrInvalidToken) {
+		t.Fatalf("Authenticate(old) after rotate: got=%v want=%v", err, gateway.ErrInvalidToken)
+	}
+	if _, err := auth.Authenticate("tok_new"); err != nil {
+		t.Fatalf("Authenticate(new) error: %v", err)
+	}
+}
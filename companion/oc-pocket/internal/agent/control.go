@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/control"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+// defaultLogLines is how many OpenCode log lines GET /opencode/logs returns without ?lines=.
+const defaultLogLines = 200
+
+// ClearLockoutsResult is returned by DELETE /lockouts on the control socket.
+type ClearLockoutsResult struct {
+	Cleared int `json:"cleared"`
+}
+
+// AgentHealth is returned by GET /health on the control socket.
+type AgentHealth struct {
+	gateway.Health
+	GatewayURL string `json:"gatewayUrl"`
+}
+
+// RestartResult is returned by POST /opencode/restart.
+type RestartResult struct {
+	Restarting bool `json:"restarting"`
+	// Rearmed is true if OpenCode had been stopped by the crash-loop breaker.
+	Rearmed bool `json:"rearmed"`
+}
+
+// controlAPI is the JSON API served on the local control socket. The same API is mounted on
+// the gateway under /__oc-pocket/admin/ for devices with the admin scope.
+type controlAPI struct {
+	configDir string
+	opencode  *openCodeSupervisor
+	// gw is set once the gateway has been created; the gateway needs the handler first.
+	gw *gateway.Server
+}
+
+func (a *controlAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, http.StatusOK, AgentHealth{Health: a.gw.Health(), GatewayURL: a.gw.BaseURL()})
+	})
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		st, ok := ReadStatus(a.configDir)
+		if !ok {
+			control.WriteError(w, http.StatusNotFound, "no status recorded yet")
+			return
+		}
+		control.WriteJSON(w, http.StatusOK, st)
+	})
+
+	mux.HandleFunc("POST /opencode/restart", func(w http.ResponseWriter, r *http.Request) {
+		rearmed := a.opencode.Restart()
+		control.WriteJSON(w, http.StatusAccepted, RestartResult{Restarting: true, Rearmed: rearmed})
+	})
+
+	mux.HandleFunc("GET /opencode/logs", func(w http.ResponseWriter, r *http.Request) {
+		n := defaultLogLines
+		if raw := r.URL.Query().Get("lines"); raw != "" {
+			v, err := strconv.Atoi(raw)
+			if err != nil || v <= 0 {
+				control.WriteError(w, http.StatusBadRequest, "lines must be a positive integer")
+				return
+			}
+			n = v
+		}
+		control.WriteJSON(w, http.StatusOK, a.opencode.Logs(n))
+	})
+
+	mux.HandleFunc("GET /lockouts", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, http.StatusOK, a.gw.Lockout().Snapshot())
+	})
+
+	mux.HandleFunc("DELETE /lockouts", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("all") == "1" {
+			control.WriteJSON(w, http.StatusOK, ClearLockoutsResult{Cleared: a.gw.Lockout().ClearAll()})
+			return
+		}
+		ip := strings.TrimSpace(r.URL.Query().Get("ip"))
+		if ip == "" {
+			control.WriteError(w, http.StatusBadRequest, "ip or all=1 is required")
+			return
+		}
+		if !a.gw.Lockout().Clear(ip) {
+			control.WriteError(w, http.StatusNotFound, "no lockout for "+ip)
+			return
+		}
+		control.WriteJSON(w, http.StatusOK, ClearLockoutsResult{Cleared: 1})
+	})
+
+	return mux
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLogLineBytes truncates very long output lines kept in memory.
+const maxLogLineBytes = 4096
+
+// LogLine is one line of OpenCode output.
+type LogLine struct {
+	TimeMs int64  `json:"timeMs"`
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+// logRing keeps the most recent lines of OpenCode output in memory so they can be fetched
+// remotely without access to the Mac's log files.
+type logRing struct {
+	mu    sync.Mutex
+	lines []LogLine
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]LogLine, size)}
+}
+
+func (r *logRing) add(stream string, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lines[r.next] = LogLine{TimeMs: time.Now().UnixMilli(), Stream: stream, Text: text}
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Tail returns up to n of the most recent lines, oldest first.
+func (r *logRing) Tail(n int) []LogLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := r.next
+	if r.full {
+		count = len(r.lines)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+	out := make([]LogLine, 0, n)
+	for i := count - n; i < count; i++ {
+		idx := i
+		if r.full {
+			idx = (r.next + i) % len(r.lines)
+		}
+		out = append(out, r.lines[idx])
+	}
+	return out
+}
+
+// Writer returns a writer that copies output to passthrough and records complete lines
+// tagged with stream.
+func (r *logRing) Writer(stream string, passthrough io.Writer) io.Writer {
+	return &logRingWriter{ring: r, stream: stream, passthrough: passthrough}
+}
+
+type logRingWriter struct {
+	ring        *logRing
+	stream      string
+	passthrough io.Writer
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *logRingWriter) Write(p []byte) (int, error) {
+	n, err := w.passthrough.Write(p)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data := p
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, data...)
+			if len(w.partial) > maxLogLineBytes {
+				w.ring.add(w.stream, string(w.partial[:maxLogLineBytes]))
+				w.partial = w.partial[:0]
+			}
+			break
+		}
+		line := append(w.partial, data[:i]...)
+		if len(line) > maxLogLineBytes {
+			line = line[:maxLogLineBytes]
+		}
+		w.ring.add(w.stream, string(bytes.TrimRight(line, "\r")))
+		w.partial = w.partial[:0]
+		data = data[i+1:]
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/logfile"
+)
+
+const (
+	// AgentLogFile receives everything the agent writes to stdout and stderr.
+	AgentLogFile = "agent.log"
+	// OpenCodeLogFile receives OpenCode's stdout and stderr.
+	OpenCodeLogFile = "opencode.log"
+	// AccessLogFile receives the gateway's JSON-lines access log when it is enabled.
+	AccessLogFile = "access.log"
+
+	DefaultLogMaxSizeMB = 10
+	DefaultLogKeep      = 5
+)
+
+// LogsDir returns where the agent keeps its log files inside the config dir.
+func LogsDir(configDir string) string {
+	return filepath.Join(configDir, "logs")
+}
+
+// Logs are the agent's rotated log files.
+type Logs struct {
+	agent    *logfile.Rotator
+	opencode *logfile.Rotator
+	// access is nil unless the access log is enabled.
+	access *logfile.Rotator
+	// out is where agent lines go: the agent log, and the terminal while stdio is captured from
+	// one.
+	out io.Writer
+
+	stdout *os.File
+	stderr *os.File
+	logOut io.Writer
+	pipe   *os.File
+	copied chan struct{}
+}
+
+// LogOptions returns the rotation settings from cfg.
+func LogOptions(cfg config.Config) logfile.Options {
+	opts := logfile.Options{
+		MaxBytes: DefaultLogMaxSizeMB << 20,
+		Keep:     DefaultLogKeep,
+		Compress: cfg.LogCompress,
+	}
+	switch {
+	case cfg.LogMaxSizeMB < 0:
+		opts.MaxBytes = 0
+	case cfg.LogMaxSizeMB > 0:
+		opts.MaxBytes = int64(cfg.LogMaxSizeMB) << 20
+	}
+	switch {
+	case cfg.LogKeep < 0:
+		opts.Keep = 0
+	case cfg.LogKeep > 0:
+		opts.Keep = cfg.LogKeep
+	}
+	return opts
+}
+
+// OpenLogs opens the agent's log files in LogsDir.
+func OpenLogs(configDir string, cfg config.Config) (*Logs, error) {
+	opts := LogOptions(cfg)
+	agentLog, err := logfile.Open(filepath.Join(LogsDir(configDir), AgentLogFile), opts)
+	if err != nil {
+		return nil, err
+	}
+	opencodeLog, err := logfile.Open(filepath.Join(LogsDir(configDir), OpenCodeLogFile), opts)
+	if err != nil {
+		_ = agentLog.Close()
+		return nil, err
+	}
+	l := &Logs{agent: agentLog, opencode: opencodeLog, out: agentLog}
+	if cfg.AccessLog {
+		if l.access, err = logfile.Open(filepath.Join(LogsDir(configDir), AccessLogFile), opts); err != nil {
+			_ = opencodeLog.Close()
+			_ = agentLog.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// CaptureStdio redirects os.Stdout, os.Stderr and the standard logger into the agent log until
+// Close. When stderr is a terminal (`oc-pocket agent` run by hand) the output is still shown
+// there too.
+func (l *Logs) CaptureStdio() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		l.out = io.MultiWriter(l.agent, os.Stderr)
+	}
+	lines := logfile.NewLineWriter(l.out, "agent")
+
+	l.stdout, l.stderr, l.logOut, l.pipe = os.Stdout, os.Stderr, log.Writer(), w
+	l.copied = make(chan struct{})
+	go func() {
+		defer close(l.copied)
+		_, _ = io.Copy(lines, r)
+		_ = r.Close()
+	}()
+	os.Stdout, os.Stderr = w, w
+	// The standard logger holds on to the stderr it was created with.
+	log.SetOutput(w)
+	return nil
+}
+
+// OpenCodeLog returns the log file for OpenCode's output.
+func (l *Logs) OpenCodeLog() io.Writer {
+	return l.opencode
+}
+
+// GatewayLog returns a writer for the gateway's diagnostics. They go to the agent log under
+// their own source so `oc-pocket logs --source gateway` can pick them out.
+func (l *Logs) GatewayLog() io.Writer {
+	return logfile.NewLineWriter(l.out, "gateway")
+}
+
+// AccessLog returns the log file for the gateway's access log, or nil if it is disabled.
+func (l *Logs) AccessLog() io.Writer {
+	if l.access == nil {
+		return nil
+	}
+	return l.access
+}
+
+// Close restores stdout and stderr and closes the log files.
+func (l *Logs) Close() error {
+	if l.pipe != nil {
+		os.Stdout, os.Stderr = l.stdout, l.stderr
+		log.SetOutput(l.logOut)
+		_ = l.pipe.Close()
+		<-l.copied
+		l.pipe = nil
+	}
+	if l.access != nil {
+		_ = l.access.Close()
+	}
+	_ = l.opencode.Close()
+	return l.agent.Close()
+}
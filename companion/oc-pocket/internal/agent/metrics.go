@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/metrics"
+)
+
+// MetricsPath is where the metrics listener serves the Prometheus text format.
+const MetricsPath = "/metrics"
+
+// MetricsAddr returns the address of the metrics endpoint, or "" if it is disabled. It only
+// ever listens on loopback: metrics are for a local Prometheus, not for paired devices.
+func MetricsAddr(cfg config.Config) string {
+	if cfg.MetricsPort <= 0 {
+		return ""
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.MetricsPort))
+}
+
+func metricsHandler(reg *metrics.Registry) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET "+MetricsPath, reg)
+	return mux
+}
+
+// registerMetrics adds the agent's and the supervisor's metrics to reg.
+func registerMetrics(reg *metrics.Registry, startedAt time.Time, s *openCodeSupervisor) {
+	reg.GaugeFunc("oc_pocket_agent_uptime_seconds", "Seconds since the agent started.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: time.Since(startedAt).Seconds()}}
+	})
+	reg.CounterFunc("oc_pocket_opencode_restarts_total", "Times OpenCode was started again after the first start.", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(max(s.starts-1, 0))
+	})
+	reg.GaugeFunc("oc_pocket_opencode_uptime_seconds", "Seconds since the current OpenCode process started; 0 if none is running.", nil, func() []metrics.Sample {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		uptime := 0.0
+		if !s.startedAt.IsZero() {
+			uptime = time.Since(s.startedAt).Seconds()
+		}
+		return []metrics.Sample{{Value: uptime}}
+	})
+}
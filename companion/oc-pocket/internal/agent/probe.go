@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+// probeSettings controls how the supervisor checks that OpenCode answers HTTP requests.
+type probeSettings struct {
+	// path is requested on OpenCode; any response below 500 counts as healthy.
+	path string
+	// readyInterval is how often a starting OpenCode is polled until it answers.
+	readyInterval time.Duration
+	// startupTimeout restarts OpenCode if it never answers after being started.
+	startupTimeout time.Duration
+	// livenessInterval is how often a running OpenCode is probed.
+	livenessInterval time.Duration
+	livenessTimeout  time.Duration
+	// livenessFailures consecutive failed probes mark the process as hung.
+	livenessFailures int
+}
+
+func defaultProbeSettings() probeSettings {
+	return probeSettings{
+		path:             "/config",
+		readyInterval:    100 * time.Millisecond,
+		startupTimeout:   time.Minute,
+		livenessInterval: 10 * time.Second,
+		livenessTimeout:  5 * time.Second,
+		livenessFailures: 3,
+	}
+}
+
+// probeOnce requests the probe path and returns how long OpenCode took to answer.
+func (s *openCodeSupervisor) probeOnce(timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	url := "http://127.0.0.1:" + strconv.Itoa(s.port) + s.probe.path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return 0, fmt.Errorf("probe %s returned %s", s.probe.path, resp.Status)
+	}
+	return time.Since(start), nil
+}
+
+// probeClient does not keep connections alive so every probe exercises OpenCode's accept loop.
+var probeClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// watch probes process gen until it exits: first for readiness, then for liveness. It sends a
+// reason on hung when the process should be restarted because it stopped answering.
+func (s *openCodeSupervisor) watch(gen int, exited <-chan struct{}, hung chan<- string) {
+	started := time.Now()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(s.probe.readyInterval):
+		}
+		latency, err := s.probeOnce(max(s.probe.readyInterval, time.Second))
+		if err == nil {
+			if !s.probed(gen, latency, true) {
+				return
+			}
+			break
+		}
+		if time.Since(started) > s.probe.startupTimeout {
+			hung <- fmt.Sprintf("not answering %s %s after %s", http.MethodGet, s.probe.path, s.probe.startupTimeout)
+			return
+		}
+	}
+
+	failures := 0
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(s.probe.livenessInterval):
+		}
+		latency, err := s.probeOnce(s.probe.livenessTimeout)
+		if err == nil {
+			failures = 0
+			if !s.probed(gen, latency, false) {
+				return
+			}
+			continue
+		}
+		failures++
+		if failures >= s.probe.livenessFailures {
+			hung <- fmt.Sprintf("%d liveness probes failed, last: %v", failures, err)
+			return
+		}
+	}
+}
+
+// probed records a successful probe of process gen, marking it running if ready is set.
+// It returns false if gen is no longer the current process.
+func (s *openCodeSupervisor) probed(gen int, latency time.Duration, ready bool) bool {
+	s.mu.Lock()
+	if s.gen != gen {
+		s.mu.Unlock()
+		return false
+	}
+	s.probeLatency = latency
+	s.lastProbeAt = time.Now()
+	if ready && s.state == gateway.UpstreamStarting {
+		s.readyAt = s.lastProbeAt
+		s.setStateLocked(gateway.UpstreamRunning)
+	}
+	s.mu.Unlock()
+
+	s.syncStatus()
+	return true
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processAlive reports whether pid exists and is not a zombie waiting to be reaped.
+func processAlive(pid int) bool {
+	raw, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesised command name.
+	stat := string(raw)
+	i := strings.LastIndexByte(stat, ')')
+	return i < 0 || i+2 >= len(stat) || stat[i+2] != 'Z'
+}
+
+func TestOpenCodeSupervisor_StopsTheWholeProcessTree(t *testing.T) {
+	cases := []struct {
+		name string
+		// trap is run by OpenCode's child before it sleeps.
+		trap  string
+		grace time.Duration
+		// minStop and maxStop bound how long stopping OpenCode may take.
+		minStop time.Duration
+		maxStop time.Duration
+	}{
+		{name: "children exit on SIGTERM", trap: "", grace: 10 * time.Second, maxStop: 3 * time.Second},
+		{name: "children ignoring SIGTERM are killed after the grace period", trap: `trap "" TERM; `, grace: 300 * time.Millisecond, minStop: 300 * time.Millisecond, maxStop: 3 * time.Second},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pidFile := filepath.Join(dir, "child.pid")
+			fake := filepath.Join(dir, "opencode")
+			script := "#!/bin/sh\nsh -c '" + tc.trap + "exec sleep 300' &\necho $! > " + pidFile + "\nexec sleep 300\n"
+			if err := os.WriteFile(fake, []byte(script), 0o755); err != nil {
+				t.Fatalf("write fake opencode: %v", err)
+			}
+
+			sup := newOpenCodeSupervisor(dir, fake, 4097, dir)
+			sup.grace = tc.grace
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- sup.run(ctx) }()
+			defer cancel()
+
+			var child int
+			deadline := time.Now().Add(5 * time.Second)
+			for child == 0 && time.Now().Before(deadline) {
+				raw, _ := os.ReadFile(pidFile)
+				child, _ = strconv.Atoi(strings.TrimSpace(string(raw)))
+				time.Sleep(20 * time.Millisecond)
+			}
+			if child == 0 || !processAlive(child) {
+				t.Fatalf("child process did not start (pid %d)", child)
+			}
+			// Give the child time to install its trap.
+			time.Sleep(100 * time.Millisecond)
+
+			start := time.Now()
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(tc.maxStop):
+				t.Fatalf("supervisor did not stop within %s", tc.maxStop)
+			}
+			if took := time.Since(start); took < tc.minStop {
+				t.Fatalf("stopped after %s; want at least the %s grace period", took, tc.minStop)
+			}
+			// SIGKILL is delivered asynchronously; allow a moment for the child to go away.
+			deadline = time.Now().Add(2 * time.Second)
+			for processAlive(child) {
+				if time.Now().After(deadline) {
+					t.Fatalf("child process %d survived shutdown", child)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestOpenCodeSupervisor_StopsChildrenWhenOpenCodeExits(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	fake := filepath.Join(dir, "opencode")
+	// Only the first run records its child, so a restart cannot overwrite the pid under test.
+	script := "#!/bin/sh\nsleep 300 &\n[ -s " + pidFile + " ] || echo $! > " + pidFile + "\nsleep 0.2\nexit 1\n"
+	if err := os.WriteFile(fake, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake opencode: %v", err)
+	}
+
+	sup := newOpenCodeSupervisor(dir, fake, 4097, dir)
+	sup.grace = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sup.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	var child int
+	deadline := time.Now().Add(5 * time.Second)
+	for child == 0 && time.Now().Before(deadline) {
+		raw, _ := os.ReadFile(pidFile)
+		child, _ = strconv.Atoi(strings.TrimSpace(string(raw)))
+		time.Sleep(20 * time.Millisecond)
+	}
+	if child == 0 {
+		t.Fatalf("child process did not start")
+	}
+
+	// The supervisor keeps running; the child must go away once its leader has exited.
+	deadline = time.Now().Add(3 * time.Second)
+	for processAlive(child) {
+		if time.Now().After(deadline) {
+			t.Fatalf("child process %d outlived OpenCode", child)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package agent
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Process groups are not available; only the direct child is stopped.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateGroup(cmd *exec.Cmd) error {
+	return killGroup(cmd)
+}
+
+func killGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return errors.New("process not started")
+	}
+	return cmd.Process.Kill()
+}
+
+func groupAlive(cmd *exec.Cmd) bool {
+	return false
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package agent
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a new process group so it can be signalled together with
+// everything it spawns (LSP servers, MCP servers, shell tools).
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func terminateGroup(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGTERM)
+}
+
+func killGroup(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGKILL)
+}
+
+// groupAlive reports whether any process in cmd's group still exists.
+func groupAlive(cmd *exec.Cmd) bool {
+	return signalGroup(cmd, syscall.Signal(0)) == nil
+}
+
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return errors.New("process not started")
+	}
+	// The group ID is the leader's PID; a negative PID addresses the whole group.
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
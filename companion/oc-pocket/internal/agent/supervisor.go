@@ -0,0 +1,405 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/logfile"
+)
+
+const (
+	// openCodeLogLines is how many lines of OpenCode output are kept for the admin API.
+	openCodeLogLines = 1000
+
+	// startupEstimate is the retry hint given to clients while OpenCode is starting.
+	startupEstimate = time.Second
+
+	// DefaultShutdownGrace is how long OpenCode gets to exit after SIGTERM.
+	DefaultShutdownGrace = 5 * time.Second
+)
+
+// restartPolicy controls how quickly OpenCode is restarted and when the supervisor gives up.
+type restartPolicy struct {
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	// stableUptime is how long OpenCode must have been ready for an exit to count as a one-off
+	// crash: the backoff is reset. Exits before that, and processes that never became ready,
+	// are fast failures.
+	stableUptime time.Duration
+	// maxFastFailures consecutive fast failures trip the crash-loop breaker: OpenCode is not
+	// restarted again until Restart is called.
+	maxFastFailures int
+}
+
+func defaultRestartPolicy() restartPolicy {
+	return restartPolicy{
+		initialBackoff:  500 * time.Millisecond,
+		maxBackoff:      10 * time.Second,
+		stableUptime:    time.Minute,
+		maxFastFailures: 5,
+	}
+}
+
+// openCodeSupervisor runs `opencode serve` and restarts it when it exits or when a restart is
+// requested through the admin API.
+type openCodeSupervisor struct {
+	configDir        string
+	opencodePath     string
+	port             int
+	defaultDirectory string
+
+	logs *logRing
+	// logFile, if set, receives OpenCode's output instead of the agent's stdout and stderr.
+	logFile   io.Writer
+	restartCh chan struct{}
+	probe     probeSettings
+	restarts  restartPolicy
+	// grace is how long OpenCode and its children get to exit after SIGTERM before they are
+	// killed. Zero kills them right away.
+	grace time.Duration
+
+	mu sync.Mutex
+	// gen identifies the current process so checks for an earlier one cannot update state.
+	gen       int
+	state     gateway.UpstreamState
+	lastError string
+	// restartAt is when a crashed OpenCode will be started again.
+	restartAt time.Time
+	// ready is closed while OpenCode is running and replaced when it stops.
+	ready chan struct{}
+	// probeLatency and lastProbeAt describe the most recent successful probe.
+	probeLatency time.Duration
+	lastProbeAt  time.Time
+	// pid and startedAt describe the running process; they are cleared when it exits.
+	pid       int
+	startedAt time.Time
+	// readyAt is when the current process first answered the readiness probe, zero until then.
+	readyAt time.Time
+	// starts counts processes started, so restarts are starts-1.
+	starts       int
+	lastExitCode *int
+}
+
+func newOpenCodeSupervisor(configDir string, opencodePath string, port int, defaultDirectory string) *openCodeSupervisor {
+	return &openCodeSupervisor{
+		configDir:        configDir,
+		opencodePath:     opencodePath,
+		port:             port,
+		defaultDirectory: defaultDirectory,
+		logs:             newLogRing(openCodeLogLines),
+		restartCh:        make(chan struct{}, 1),
+		probe:            defaultProbeSettings(),
+		restarts:         defaultRestartPolicy(),
+		grace:            DefaultShutdownGrace,
+		state:            gateway.UpstreamStarting,
+		ready:            make(chan struct{}),
+	}
+}
+
+// Restart asks the supervisor to stop OpenCode and start it again immediately. The agent and
+// the gateway keep running. Requests made while a restart is pending are coalesced.
+//
+// Restart also re-arms the crash-loop breaker; it reports whether the breaker had tripped.
+func (s *openCodeSupervisor) Restart() (rearmed bool) {
+	s.mu.Lock()
+	rearmed = s.state == gateway.UpstreamStopped
+	s.mu.Unlock()
+
+	select {
+	case s.restartCh <- struct{}{}:
+	default:
+	}
+	return rearmed
+}
+
+// Logs returns up to n of the most recent lines OpenCode wrote to stdout or stderr.
+func (s *openCodeSupervisor) Logs(n int) []LogLine {
+	return s.logs.Tail(n)
+}
+
+// Status reports the state of OpenCode for the gateway.
+func (s *openCodeSupervisor) Status() gateway.UpstreamStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := gateway.UpstreamStatus{State: s.state, LastError: s.lastError}
+	switch s.state {
+	case gateway.UpstreamStarting:
+		st.RetryAfter = startupEstimate
+	case gateway.UpstreamCrashed:
+		st.RetryAfter = max(time.Until(s.restartAt), 0) + startupEstimate
+	}
+	return st
+}
+
+// AwaitReady blocks until OpenCode is accepting connections or ctx is done.
+func (s *openCodeSupervisor) AwaitReady(ctx context.Context) error {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ready reports whether OpenCode is accepting connections.
+func (s *openCodeSupervisor) Ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == gateway.UpstreamRunning
+}
+
+func (s *openCodeSupervisor) starting() int {
+	s.mu.Lock()
+	s.gen++
+	gen := s.gen
+	s.readyAt = time.Time{}
+	s.setStateLocked(gateway.UpstreamStarting)
+	s.mu.Unlock()
+
+	s.syncStatus()
+	return gen
+}
+
+func (s *openCodeSupervisor) started(pid int, at time.Time) {
+	s.mu.Lock()
+	s.pid = pid
+	s.startedAt = at
+	s.starts++
+	s.mu.Unlock()
+
+	s.syncStatus()
+}
+
+// exited records how the process ended. err is the result of cmd.Wait.
+func (s *openCodeSupervisor) exited(err error) {
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// -1 if the process was killed by a signal.
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		code = -1
+	}
+
+	s.mu.Lock()
+	s.pid = 0
+	s.startedAt = time.Time{}
+	s.lastExitCode = &code
+	s.mu.Unlock()
+
+	s.syncStatus()
+}
+
+// readySince returns when the current process became ready, zero if it never did.
+func (s *openCodeSupervisor) readySince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readyAt
+}
+
+func (s *openCodeSupervisor) crashed(lastError string, restartAt time.Time) {
+	s.mu.Lock()
+	s.setStateLocked(gateway.UpstreamCrashed)
+	s.lastError = lastError
+	s.restartAt = restartAt
+	s.mu.Unlock()
+
+	s.syncStatus()
+}
+
+// stopped records that the crash-loop breaker tripped.
+func (s *openCodeSupervisor) stopped(lastError string) {
+	s.mu.Lock()
+	s.setStateLocked(gateway.UpstreamStopped)
+	s.lastError = lastError
+	s.mu.Unlock()
+
+	s.syncStatus()
+}
+
+// syncStatus records the supervisor's state in status.json.
+func (s *openCodeSupervisor) syncStatus() {
+	s.mu.Lock()
+	st := OpenCodeStatus{
+		State:          string(s.state),
+		Ready:          s.state == gateway.UpstreamRunning,
+		ProbeLatencyMs: s.probeLatency.Milliseconds(),
+		PID:            s.pid,
+		Restarts:       max(s.starts-1, 0),
+		LastExitCode:   s.lastExitCode,
+	}
+	if !s.lastProbeAt.IsZero() {
+		st.LastProbeAtMs = s.lastProbeAt.UnixMilli()
+	}
+	if !s.startedAt.IsZero() {
+		st.StartedAtMs = s.startedAt.UnixMilli()
+	}
+	s.mu.Unlock()
+
+	updateStatus(s.configDir, func(status *Status) { status.OpenCode = st })
+}
+
+func (s *openCodeSupervisor) setStateLocked(state gateway.UpstreamState) {
+	wasRunning := s.state == gateway.UpstreamRunning
+	s.state = state
+	switch {
+	case state == gateway.UpstreamRunning && !wasRunning:
+		close(s.ready)
+	case state != gateway.UpstreamRunning && wasRunning:
+		s.ready = make(chan struct{})
+	}
+}
+
+// stop sends SIGTERM to OpenCode's process group, waits up to the grace period for the whole
+// group to exit, then SIGKILLs whatever is left. waitCh receives the result of cmd.Wait, which
+// stop returns.
+func (s *openCodeSupervisor) stop(cmd *exec.Cmd, waitCh <-chan error) error {
+	if s.grace <= 0 || terminateGroup(cmd) != nil {
+		_ = killGroup(cmd)
+		return <-waitCh
+	}
+
+	deadline := time.NewTimer(s.grace)
+	defer deadline.Stop()
+	poll := time.NewTicker(50 * time.Millisecond)
+	defer poll.Stop()
+
+	var waitErr error
+	leaderDone := false
+	for {
+		select {
+		case waitErr = <-waitCh:
+			leaderDone = true
+		case <-poll.C:
+		case <-deadline.C:
+			_ = killGroup(cmd)
+			if !leaderDone {
+				waitErr = <-waitCh
+			}
+			return waitErr
+		}
+		if leaderDone && !groupAlive(cmd) {
+			return waitErr
+		}
+	}
+}
+
+func (s *openCodeSupervisor) run(ctx context.Context) error {
+	backoff := s.restarts.initialBackoff
+	fastFailures := 0
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		cmd := exec.Command(s.opencodePath, "serve", "--hostname", "127.0.0.1", "--port", strconv.Itoa(s.port))
+		cmd.Dir = s.defaultDirectory
+		var stdout, stderr io.Writer = os.Stdout, os.Stderr
+		if s.logFile != nil {
+			stdout = logfile.NewLineWriter(s.logFile, "opencode")
+			stderr = logfile.NewLineWriter(s.logFile, "opencode")
+		}
+		cmd.Stdout = s.logs.Writer("stdout", stdout)
+		cmd.Stderr = s.logs.Writer("stderr", stderr)
+		cmd.Env = os.Environ()
+		// Children inherit OpenCode's output pipes. Without a delay Wait would not return after
+		// OpenCode exits for as long as any of them is still running.
+		cmd.WaitDelay = time.Second
+		setProcessGroup(cmd)
+
+		gen := s.starting()
+		if err := cmd.Start(); err != nil {
+			s.crashed("start: "+err.Error(), time.Time{})
+			writeStatus(s.configDir, "opencode start: "+err.Error())
+			return err
+		}
+		s.started(cmd.Process.Pid, time.Now())
+
+		waitCh := make(chan error, 1)
+		exited := make(chan struct{})
+		go func() {
+			err := cmd.Wait()
+			close(exited)
+			waitCh <- err
+		}()
+		hung := make(chan string, 1)
+		go s.watch(gen, exited, hung)
+
+		var reason string
+		select {
+		case <-ctx.Done():
+			s.exited(s.stop(cmd, waitCh))
+			return nil
+		case <-s.restartCh:
+			s.exited(s.stop(cmd, waitCh))
+			backoff = s.restarts.initialBackoff
+			fastFailures = 0
+			continue
+		case why := <-hung:
+			s.exited(s.stop(cmd, waitCh))
+			reason = "unresponsive: " + why
+		case err := <-waitCh:
+			// OpenCode is gone, but the LSP and MCP servers it started may not be. Stop the rest
+			// of its group like on a requested stop.
+			leaderDone := make(chan error, 1)
+			leaderDone <- err
+			s.exited(s.stop(cmd, leaderDone))
+			// Restart on unexpected exit.
+			if ctx.Err() != nil {
+				return nil
+			}
+			reason = "exited: " + exitErrorString(err)
+		}
+
+		// A process that stayed ready for a while was healthy; start over with a short backoff.
+		// One that never answered (e.g. killed by the startup timeout) always counts as a fast
+		// failure, however long it took to give up on it.
+		if readyAt := s.readySince(); !readyAt.IsZero() && time.Since(readyAt) >= s.restarts.stableUptime {
+			backoff = s.restarts.initialBackoff
+			fastFailures = 0
+		} else {
+			fastFailures++
+		}
+
+		if fastFailures >= s.restarts.maxFastFailures {
+			msg := fmt.Sprintf("opencode failed %d times in a row without staying ready for %s; not restarting it until `oc-pocket restart --opencode` (last: %s)",
+				fastFailures, s.restarts.stableUptime, reason)
+			writeStatus(s.configDir, msg)
+			s.stopped(msg)
+			fmt.Fprintln(os.Stderr, "oc-pocket: "+msg)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-s.restartCh:
+				backoff = s.restarts.initialBackoff
+				fastFailures = 0
+				continue
+			}
+		}
+
+		s.crashed(reason, time.Now().Add(backoff))
+		writeStatus(s.configDir, "opencode "+reason)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.restartCh:
+			backoff = s.restarts.initialBackoff
+			fastFailures = 0
+		case <-time.After(backoff):
+			backoff = min(backoff*2, s.restarts.maxBackoff)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+// TestMain lets the test binary act as a fake `opencode serve` when re-executed by the
+// supervisor under test.
+func TestMain(m *testing.M) {
+	if os.Getenv("OC_POCKET_FAKE_OPENCODE") == "1" {
+		fakeOpenCode(os.Args[1:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeOpenCode serves 200 OK on the port passed as `--port`.
+func fakeOpenCode(args []string) {
+	port := ""
+	for i, a := range args {
+		if a == "--port" && i+1 < len(args) {
+			port = args[i+1]
+		}
+	}
+	fmt.Println("fake opencode listening on " + port)
+	hang := os.Getenv("OC_POCKET_FAKE_OPENCODE_HANG") == "1"
+	var requests atomic.Int32
+	_ = http.ListenAndServe("127.0.0.1:"+port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// With HANG set, answer the readiness probe and then stop responding.
+		if hang && requests.Add(1) > 1 {
+			select {}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	os.Exit(1)
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestLogRing_TailKeepsMostRecentLines(t *testing.T) {
+	ring := newLogRing(3)
+	w := ring.Writer("stdout", io.Discard)
+
+	_, _ = w.Write([]byte("one\ntwo\nthr"))
+	_, _ = w.Write([]byte("ee\nfour\npartial"))
+
+	got := ring.Tail(10)
+	var texts []string
+	for _, l := range got {
+		texts = append(texts, l.Text)
+	}
+	if strings.Join(texts, ",") != "two,three,four" {
+		t.Fatalf("tail: got=%v", texts)
+	}
+	if tail := ring.Tail(1); len(tail) != 1 || tail[0].Text != "four" || tail[0].Stream != "stdout" {
+		t.Fatalf("tail(1): got=%+v", tail)
+	}
+}
+
+func TestOpenCodeSupervisor_RestartRunsANewProcess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the fake opencode binary")
+	}
+
+	dir := t.TempDir()
+	fake := filepath.Join(dir, "opencode")
+	script := "#!/bin/sh\necho \"started $$\"\nexec sleep 30\n"
+	if err := os.WriteFile(fake, []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake opencode: %v", err)
+	}
+
+	sup := newOpenCodeSupervisor(dir, fake, 4097, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sup.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	waitForLines := func(n int) []LogLine {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if lines := sup.Logs(0); len(lines) >= n {
+				return lines
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %d log lines; got=%+v", n, sup.Logs(0))
+		return nil
+	}
+
+	first := waitForLines(1)
+	sup.Restart()
+	second := waitForLines(2)
+	if first[0].Text == second[1].Text {
+		t.Fatalf("expected a new process after restart; logs=%+v", second)
+	}
+	for _, l := range second {
+		if !strings.HasPrefix(l.Text, "started ") {
+			t.Fatalf("unexpected log line: %s", fmt.Sprint(l))
+		}
+	}
+
+	// The second process's PID is the one in its log line.
+	wantPID := strings.TrimPrefix(second[1].Text, "started ")
+	var st Status
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if st, _ = ReadStatus(dir); fmt.Sprint(st.OpenCode.PID) == wantPID {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	oc := st.OpenCode
+	if fmt.Sprint(oc.PID) != wantPID || oc.StartedAtMs == 0 || oc.Restarts != 1 {
+		t.Fatalf("status after restart: got=%+v want pid=%s restarts=1", oc, wantPID)
+	}
+	if oc.LastExitCode == nil || *oc.LastExitCode != -1 {
+		t.Fatalf("last exit code: got=%v want -1 (terminated by signal)", oc.LastExitCode)
+	}
+}
+
+func TestOpenCodeSupervisor_ReadyOnceListening(t *testing.T) {
+	t.Setenv("OC_POCKET_FAKE_OPENCODE", "1")
+
+	dir := t.TempDir()
+	sup := newOpenCodeSupervisor(dir, os.Args[0], freePort(t), dir)
+	if st := sup.Status(); st.State != gateway.UpstreamStarting || st.RetryAfter <= 0 {
+		t.Fatalf("initial status: got=%+v", st)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sup.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	awaitReady := func() {
+		t.Helper()
+		waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Second)
+		defer waitCancel()
+		if err := sup.AwaitReady(waitCtx); err != nil {
+			t.Fatalf("AwaitReady() error: %v (status %+v)", err, sup.Status())
+		}
+		if !sup.Ready() || sup.Status().State != gateway.UpstreamRunning {
+			t.Fatalf("status after ready: got=%+v", sup.Status())
+		}
+		// status.json is written right after the state changes.
+		var st Status
+		for i := 0; i < 100; i++ {
+			if st, _ = ReadStatus(dir); st.OpenCode.Ready {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !st.OpenCode.Ready || st.OpenCode.State != "running" || st.OpenCode.LastProbeAtMs == 0 {
+			t.Fatalf("status.json after ready: got=%+v", st.OpenCode)
+		}
+	}
+
+	awaitReady()
+	sup.Restart()
+	// The restart kills the process; it becomes ready again once the new one listens.
+	deadline := time.Now().Add(5 * time.Second)
+	for sup.Ready() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	awaitReady()
+}
+
+func TestOpenCodeSupervisor_RestartsHungProcess(t *testing.T) {
+	t.Setenv("OC_POCKET_FAKE_OPENCODE", "1")
+	t.Setenv("OC_POCKET_FAKE_OPENCODE_HANG", "1")
+
+	dir := t.TempDir()
+	sup := newOpenCodeSupervisor(dir, os.Args[0], freePort(t), dir)
+	sup.probe.livenessInterval = 50 * time.Millisecond
+	sup.probe.livenessTimeout = 50 * time.Millisecond
+	sup.probe.livenessFailures = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sup.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if st, _ := ReadStatus(dir); strings.Contains(st.LastError, "unresponsive") {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	st, _ := ReadStatus(dir)
+	t.Fatalf("hung process was not restarted; status=%+v supervisor=%+v", st, sup.Status())
+}
+
+func TestOpenCodeSupervisor_CrashLoopTripsBreakerUntilRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the fake opencode binary")
+	}
+
+	dir := t.TempDir()
+	fake := filepath.Join(dir, "opencode")
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\necho 'bad config' >&2\nexit 3\n"), 0o755); err != nil {
+		t.Fatalf("write fake opencode: %v", err)
+	}
+
+	sup := newOpenCodeSupervisor(dir, fake, freePort(t), dir)
+	sup.restarts = restartPolicy{
+		initialBackoff:  10 * time.Millisecond,
+		maxBackoff:      20 * time.Millisecond,
+		stableUptime:    time.Minute,
+		maxFastFailures: 3,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sup.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	waitForState := func(want gateway.UpstreamState) gateway.UpstreamStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if st := sup.Status(); st.State == want {
+				return st
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %q; status=%+v", want, sup.Status())
+		return gateway.UpstreamStatus{}
+	}
+
+	st := waitForState(gateway.UpstreamStopped)
+	if !strings.Contains(st.LastError, "3 times") || !strings.Contains(st.LastError, "exit status 3") {
+		t.Fatalf("lastError should explain the crash loop: %q", st.LastError)
+	}
+	var recorded Status
+	for i := 0; i < 100; i++ {
+		if recorded, _ = ReadStatus(dir); recorded.OpenCode.State == "stopped" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if recorded.LastError != st.LastError || recorded.OpenCode.State != "stopped" {
+		t.Fatalf("status.json: got=%+v", recorded)
+	}
+
+	// The breaker holds: no further attempts are made.
+	lines := len(sup.Logs(0))
+	time.Sleep(100 * time.Millisecond)
+	if n := len(sup.Logs(0)); n != lines {
+		t.Fatalf("OpenCode was restarted while the breaker was open (%d -> %d log lines)", lines, n)
+	}
+
+	if !sup.Restart() {
+		t.Fatalf("Restart() should report re-arming the breaker")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sup.Logs(0)) == lines && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(sup.Logs(0)) == lines {
+		t.Fatalf("OpenCode was not started again after re-arming")
+	}
+}
+
+func TestOpenCodeSupervisor_NeverReadyCountsAsFastFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the fake opencode binary")
+	}
+
+	// The process starts fine but never listens, so it is killed by the startup timeout. That
+	// takes longer than stableUptime here, yet must not count as a stable run.
+	dir := t.TempDir()
+	fake := filepath.Join(dir, "opencode")
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\nexec sleep 300\n"), 0o755); err != nil {
+		t.Fatalf("write fake opencode: %v", err)
+	}
+
+	sup := newOpenCodeSupervisor(dir, fake, freePort(t), dir)
+	sup.grace = 0
+	sup.probe.readyInterval = 10 * time.Millisecond
+	sup.probe.startupTimeout = 100 * time.Millisecond
+	sup.restarts = restartPolicy{
+		initialBackoff:  10 * time.Millisecond,
+		maxBackoff:      20 * time.Millisecond,
+		stableUptime:    50 * time.Millisecond,
+		maxFastFailures: 3,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sup.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if st := sup.Status(); st.State == gateway.UpstreamStopped {
+			if !strings.Contains(st.LastError, "3 times") || !strings.Contains(st.LastError, "not answering") {
+				t.Fatalf("lastError should explain the startup timeouts: %q", st.LastError)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("breaker did not trip for a process that never became ready; status=%+v", sup.Status())
+}
@@ -0,0 +1,263 @@
+// Package audit keeps a record of the state-changing actions devices perform through the
+// gateway.
+//
+// The log is a file of JSON lines. Every entry carries the hash of the entry before it and a
+// hash over itself, so editing, inserting or deleting a line breaks the chain from that point
+// on. The hashes are not keyed: whoever can write the file can also recompute the chain after
+// changing it. Such a rewrite, like cutting entries off the end, only shows against a head hash
+// noted somewhere else earlier, which `oc-pocket audit` prints.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileName is the audit log inside the config dir.
+const FileName = "audit.log"
+
+// Path returns the audit log in configDir.
+func Path(configDir string) string {
+	return filepath.Join(configDir, FileName)
+}
+
+// Entry is one audited action.
+type Entry struct {
+	Seq    int64  `json:"seq"`
+	AtMs   int64  `json:"atMs"`
+	Device string `json:"device"`
+	// Action is what was done, e.g. "prompt", "abort" or "permission_reply".
+	Action    string `json:"action"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Session   string `json:"session,omitempty"`
+	Directory string `json:"directory,omitempty"`
+	// BodySHA256 is the hex SHA-256 of the request body as forwarded to OpenCode, or empty if
+	// the request failed before the body was read.
+	BodySHA256 string `json:"bodySha256"`
+	BodyBytes  int64  `json:"bodyBytes"`
+	// Status is the HTTP status the device got back; 0 if it disconnected first. Error holds
+	// the start of the response body for failures.
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Prev is the Hash of the previous entry, empty for the first one.
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+// computeHash hashes the entry with its Hash field cleared.
+func (e Entry) computeHash() string {
+	e.Hash = ""
+	raw, _ := json.Marshal(e)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Log appends entries to an audit log. It is safe for concurrent use.
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	prev string
+}
+
+// Open opens the audit log at path for appending, creating it if needed, and continues the
+// chain from its last entry.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f}
+	entries, tail, err := read(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Hash != "" {
+			l.seq, l.prev = entries[i].Seq, entries[i].Hash
+			break
+		}
+	}
+	if len(tail) > 0 {
+		if err := l.repairTail(tail); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// repairTail deals with a last line that has no newline, left by a crash during Append. If the
+// entry was written out in full and continues the chain, only its newline is added. Otherwise
+// the partial line is cut off so it cannot break the chain for every later entry.
+func (l *Log) repairTail(tail []byte) error {
+	if e, ok := parseEntry(tail); ok && e.Seq == l.seq+1 && e.Prev == l.prev && e.computeHash() == e.Hash {
+		if _, err := l.f.Write([]byte("\n")); err != nil {
+			return err
+		}
+		l.seq, l.prev = e.Seq, e.Hash
+		return nil
+	}
+	info, err := l.f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := l.f.Truncate(info.Size() - int64(len(tail))); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Append chains e to the log and writes it. Seq, Prev and Hash are filled in.
+func (l *Log) Append(e Entry) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return Entry{}, os.ErrClosed
+	}
+	e.Seq = l.seq + 1
+	e.Prev = l.prev
+	e.Hash = e.computeHash()
+
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, err := l.f.Write(append(raw, '\n')); err != nil {
+		return Entry{}, err
+	}
+	if err := l.f.Sync(); err != nil {
+		return Entry{}, err
+	}
+	l.seq, l.prev = e.Seq, e.Hash
+	return e, nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// Read returns every entry in the audit log at path. A log that does not exist is empty.
+func Read(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	entries, tail, err := read(f)
+	if err != nil {
+		return nil, err
+	}
+	// An unterminated last line is an entry still being written, or the remains of a crash
+	// that the next Open cuts off.
+	if e, ok := parseEntry(tail); ok {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// read parses the newline-terminated entries in r and returns any unterminated last line as
+// tail. Lines that are not valid JSON are kept as zero entries so Verify reports them.
+func read(r io.Reader) (entries []Entry, tail []byte, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return entries, line, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var e Entry
+			_ = json.Unmarshal(line, &e)
+			entries = append(entries, e)
+		}
+	}
+}
+
+// parseEntry parses a line that holds a complete entry.
+func parseEntry(line []byte) (Entry, bool) {
+	var e Entry
+	if err := json.Unmarshal(bytes.TrimSpace(line), &e); err != nil || e.Hash == "" {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// ChainError reports the first entry at which the chain is broken.
+type ChainError struct {
+	// Line is the 1-based line of the entry in the log.
+	Line   int
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit log tampered with or corrupt at entry %d: %s", e.Line, e.Reason)
+}
+
+// Verify checks that entries form an unbroken chain from the start of the log.
+func Verify(entries []Entry) error {
+	prev := ""
+	for i, e := range entries {
+		switch {
+		case e.Hash == "":
+			return &ChainError{Line: i + 1, Reason: "not a valid entry"}
+		case e.Seq != int64(i+1):
+			return &ChainError{Line: i + 1, Reason: fmt.Sprintf("sequence number is %d", e.Seq)}
+		case e.Prev != prev:
+			return &ChainError{Line: i + 1, Reason: "does not follow the previous entry"}
+		case e.computeHash() != e.Hash:
+			return &ChainError{Line: i + 1, Reason: "contents do not match its hash"}
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// Filter selects entries by session and time. Zero fields match everything.
+type Filter struct {
+	Session string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f Filter) Match(e Entry) bool {
+	at := time.UnixMilli(e.AtMs)
+	switch {
+	case f.Session != "" && e.Session != f.Session:
+		return false
+	case !f.Since.IsZero() && at.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !at.Before(f.Until):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package audit_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/audit"
+)
+
+func appendEntries(t *testing.T, path string, entries ...audit.Entry) {
+	t.Helper()
+	l, err := audit.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	for _, e := range entries {
+		if _, err := l.Append(e); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func TestLog_ChainsAcrossReopens(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), audit.FileName)
+	appendEntries(t, path, audit.Entry{Device: "phone", Action: "prompt", Session: "ses_1"})
+	appendEntries(t, path, audit.Entry{Device: "phone", Action: "abort", Session: "ses_1"})
+
+	entries, err := audit.Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Seq != 2 || entries[1].Prev != entries[0].Hash {
+		t.Fatalf("entries: got=%+v", entries)
+	}
+	if err := audit.Verify(entries); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("perm: got=%04o want=0600", perm)
+	}
+}
+
+func TestOpen_RecoversFromTornLastLine(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		// tear damages the end of a log holding two entries.
+		tear func(raw []byte) []byte
+		want int
+	}{
+		{
+			name: "partial entry is cut off",
+			tear: func(raw []byte) []byte { return append(raw, `{"seq":3,"atMs":17000000`...) },
+			want: 3,
+		},
+		{
+			name: "complete entry missing its newline is kept",
+			tear: func(raw []byte) []byte { return raw[:len(raw)-1] },
+			want: 3,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), audit.FileName)
+			appendEntries(t, path, audit.Entry{Action: "prompt"}, audit.Entry{Action: "abort"})
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if err := os.WriteFile(path, tc.tear(raw), 0o600); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			appendEntries(t, path, audit.Entry{Action: "fork"})
+
+			entries, err := audit.Read(path)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if err := audit.Verify(entries); err != nil {
+				t.Fatalf("Verify after recovery: %v", err)
+			}
+			if len(entries) != tc.want || entries[len(entries)-1].Action != "fork" || entries[len(entries)-1].Seq != int64(tc.want) {
+				t.Fatalf("entries: got=%+v", entries)
+			}
+		})
+	}
+}
+
+func TestVerify_DetectsEditsAndDeletions(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), audit.FileName)
+	appendEntries(t, path,
+		audit.Entry{Device: "phone", Action: "prompt", Session: "ses_1"},
+		audit.Entry{Device: "phone", Action: "revert", Session: "ses_1"},
+		audit.Entry{Device: "phone", Action: "fork", Session: "ses_1"},
+	)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	lines := strings.SplitAfter(string(raw), "\n")
+
+	cases := map[string]string{
+		"edited":  strings.Replace(string(raw), `"revert"`, `"prompt"`, 1),
+		"deleted": lines[0] + lines[2],
+	}
+	for name, contents := range cases {
+		tampered := filepath.Join(t.TempDir(), audit.FileName)
+		if err := os.WriteFile(tampered, []byte(contents), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		entries, err := audit.Read(tampered)
+		if err != nil {
+			t.Fatalf("%s: Read: %v", name, err)
+		}
+		var chainErr *audit.ChainError
+		if err := audit.Verify(entries); !errors.As(err, &chainErr) || chainErr.Line != 2 {
+			t.Fatalf("%s: Verify: got=%v", name, err)
+		}
+	}
+}
+
+func TestFilter_MatchesSessionAndTimeRange(t *testing.T) {
+	t.Parallel()
+
+	at := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	e := audit.Entry{Session: "ses_1", AtMs: at.UnixMilli()}
+	cases := []struct {
+		filter audit.Filter
+		want   bool
+	}{
+		{audit.Filter{}, true},
+		{audit.Filter{Session: "ses_1"}, true},
+		{audit.Filter{Session: "ses_2"}, false},
+		{audit.Filter{Since: at.Add(-time.Hour), Until: at.Add(time.Hour)}, true},
+		{audit.Filter{Since: at.Add(time.Minute)}, false},
+		{audit.Filter{Until: at}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.Match(e); got != c.want {
+			t.Fatalf("%+v: got=%v want=%v", c.filter, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/fsutil"
+)
+
+// DefaultDevice is the device name used by `setup` and for tokens migrated from the legacy
+// single-token file.
+const DefaultDevice = "default"
+
+var (
+	ErrDeviceNotFound = errors.New("device not found")
+	ErrDeviceExists   = errors.New("device already exists")
+	ErrDeviceRevoked  = errors.New("device revoked")
+)
+
+// Device is a paired client. Every device has its own bearer token so it can be revoked
+// without re-pairing the others.
+type Device struct {
+	Name         string `json:"name"`
+	Token        string `json:"token"`
+	Scope        Scope  `json:"scope,omitempty"`
+	CreatedAtMs  int64  `json:"createdAtMs"`
+	LastSeenAtMs int64  `json:"lastSeenAtMs,omitempty"`
+	RevokedAtMs  int64  `json:"revokedAtMs,omitempty"`
+}
+
+func (d Device) Revoked() bool {
+	return d.RevokedAtMs != 0
+}
+
+// EffectiveScope returns the device's scope. Devices registered before scopes existed had full
+// access and keep it.
+func (d Device) EffectiveScope() Scope {
+	if d.Scope == "" {
+		return ScopeAdmin
+	}
+	return d.Scope
+}
+
+type devicesFile struct {
+	Devices []Device `json:"devices"`
+}
+
+// DeviceRegistry persists paired devices in devices.json under BaseDir.
+//
+// The CLI and the agent both write this file (revoke vs. last-seen updates), so every mutation
+// holds an exclusive lock on devices.json.lock while it reads, changes and writes the file.
+type DeviceRegistry struct {
+	BaseDir string
+}
+
+func (r DeviceRegistry) Path() string {
+	return filepath.Join(r.BaseDir, "devices.json")
+}
+
+func (r DeviceRegistry) lockPath() string {
+	return r.Path() + ".lock"
+}
+
+// List returns all devices (including revoked ones) sorted by name.
+// A missing registry file is treated as empty.
+func (r DeviceRegistry) List() ([]Device, error) {
+	if r.BaseDir == "" {
+		return nil, errors.New("BaseDir is required")
+	}
+	raw, err := os.ReadFile(r.Path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f devicesFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("read devices: %w", err)
+	}
+	sort.Slice(f.Devices, func(i, j int) bool { return f.Devices[i].Name < f.Devices[j].Name })
+	return f.Devices, nil
+}
+
+func (r DeviceRegistry) Get(name string) (Device, error) {
+	devices, err := r.List()
+	if err != nil {
+		return Device{}, err
+	}
+	for _, d := range devices {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return Device{}, ErrDeviceNotFound
+}
+
+// Add registers a new device. A revoked device with the same name is replaced.
+func (r DeviceRegistry) Add(name string, token string, scope Scope, now time.Time) (Device, error) {
+	if err := ValidateDeviceName(name); err != nil {
+		return Device{}, err
+	}
+	if strings.TrimSpace(token) == "" {
+		return Device{}, errors.New("token is required")
+	}
+	if _, err := ParseScope(string(scope)); err != nil {
+		return Device{}, err
+	}
+	d := Device{
+		Name:        name,
+		Token:       token,
+		Scope:       scope,
+		CreatedAtMs: now.UnixMilli(),
+	}
+	err := r.update(func(devices []Device) ([]Device, error) {
+		out := devices[:0]
+		for _, existing := range devices {
+			if existing.Token == token {
+				return nil, errors.New("token already in use")
+			}
+			if existing.Name == name {
+				if !existing.Revoked() {
+					return nil, fmt.Errorf("%w: %s", ErrDeviceExists, name)
+				}
+				continue
+			}
+			out = append(out, existing)
+		}
+		return append(out, d), nil
+	})
+	if err != nil {
+		return Device{}, err
+	}
+	return d, nil
+}
+
+// Revoke marks a device as revoked. Its token stops working as soon as the agent notices the
+// registry changed.
+func (r DeviceRegistry) Revoke(name string, now time.Time) error {
+	return r.update(func(devices []Device) ([]Device, error) {
+		for i := range devices {
+			if devices[i].Name != name {
+				continue
+			}
+			if devices[i].Revoked() {
+				return nil, fmt.Errorf("%w: %s", ErrDeviceRevoked, name)
+			}
+			devices[i].RevokedAtMs = now.UnixMilli()
+			return devices, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, name)
+	})
+}
+
+// RotateToken replaces the token of an active device.
+func (r DeviceRegistry) RotateToken(name string, token string) error {
+	if strings.TrimSpace(token) == "" {
+		return errors.New("token is required")
+	}
+	return r.update(func(devices []Device) ([]Device, error) {
+		for i := range devices {
+			if devices[i].Name != name {
+				continue
+			}
+			if devices[i].Revoked() {
+				return nil, fmt.Errorf("%w: %s", ErrDeviceRevoked, name)
+			}
+			devices[i].Token = token
+			return devices, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrDeviceNotFound, name)
+	})
+}
+
+// Touch records that a device was seen at the given time. Unknown or revoked devices are ignored.
+func (r DeviceRegistry) Touch(name string, seen time.Time) error {
+	return r.update(func(devices []Device) ([]Device, error) {
+		for i := range devices {
+			if devices[i].Name == name && !devices[i].Revoked() {
+				devices[i].LastSeenAtMs = seen.UnixMilli()
+			}
+		}
+		return devices, nil
+	})
+}
+
+// MigrateLegacyToken imports the single shared `token` file written by older versions as the
+// DefaultDevice with admin scope, then removes it. It is a no-op once a registry exists.
+func (r DeviceRegistry) MigrateLegacyToken(now time.Time) (migrated bool, err error) {
+	if r.BaseDir == "" {
+		return false, errors.New("BaseDir is required")
+	}
+	if _, err := os.Stat(r.Path()); err == nil {
+		return false, nil
+	}
+	legacyPath := filepath.Join(r.BaseDir, "token")
+	raw, err := os.ReadFile(legacyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	token := strings.TrimSpace(string(raw))
+	if token != "" {
+		if _, err := r.Add(DefaultDevice, token, ScopeAdmin, now); err != nil {
+			return false, err
+		}
+	}
+	if err := os.Remove(legacyPath); err != nil {
+		return false, err
+	}
+	return token != "", nil
+}
+
+// update applies fn to the registry under the registry lock. The file is only rewritten if fn
+// changed something.
+func (r DeviceRegistry) update(fn func([]Device) ([]Device, error)) error {
+	if r.BaseDir == "" {
+		return errors.New("BaseDir is required")
+	}
+	if err := os.MkdirAll(r.BaseDir, 0o700); err != nil {
+		return err
+	}
+	unlock, err := lockFile(r.lockPath())
+	if err != nil {
+		return fmt.Errorf("lock devices: %w", err)
+	}
+	defer unlock()
+
+	devices, err := r.List()
+	if err != nil {
+		return err
+	}
+	before, err := json.Marshal(devices)
+	if err != nil {
+		return err
+	}
+	devices, err = fn(devices)
+	if err != nil {
+		return err
+	}
+	if devices == nil {
+		devices = []Device{}
+	}
+	if after, err := json.Marshal(devices); err == nil && bytes.Equal(before, after) {
+		return nil
+	}
+	raw, err := json.MarshalIndent(devicesFile{Devices: devices}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fsutil.AtomicWriteFile(r.Path(), raw, 0o600); err != nil {
+		return fmt.Errorf("write devices: %w", err)
+	}
+	return nil
+}
+
+// ValidateDeviceName restricts names to a shell-friendly charset since they are passed as
+// CLI arguments (`oc-pocket devices revoke <name>`).
+func ValidateDeviceName(name string) error {
+	if name == "" {
+		return errors.New("device name is required")
+	}
+	if len(name) > 64 {
+		return errors.New("device name is too long (max 64 characters)")
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return fmt.Errorf("invalid device name %q (use letters, digits, '-', '_' or '.')", name)
+		}
+	}
+	return nil
+}
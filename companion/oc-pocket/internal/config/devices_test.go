@@ -0,0 +1,204 @@
+package config_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+)
+
+func TestDeviceRegistry_AddRevokeTouch(t *testing.T) {
+	t.Parallel()
+
+	baseDir := t.TempDir()
+	reg := config.DeviceRegistry{BaseDir: baseDir}
+	now := time.UnixMilli(1_700_000_000_000)
+
+	if _, err := reg.Add("iphone", "tok_a", config.ScopeChat, now); err != nil {
+		t.Fatalf("Add(iphone) error: %v", err)
+	}
+	if _, err := reg.Add("ipad", "tok_b", config.ScopeRead, now); err != nil {
+		t.Fatalf("Add(ipad) error: %v", err)
+	}
+	if _, err := reg.Add("iphone", "tok_c", config.ScopeChat, now); !errors.Is(err, config.ErrDeviceExists) {
+		t.Fatalf("Add(duplicate) error: got=%v want=%v", err, config.ErrDeviceExists)
+	}
+
+	if err := reg.Touch("ipad", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Touch() error: %v", err)
+	}
+	if err := reg.Revoke("iphone", now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("Revoke() error: %v", err)
+	}
+
+	devices, err := reg.List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	if len(devices) != 2 || devices[0].Name != "ipad" || devices[1].Name != "iphone" {
+		t.Fatalf("devices: got=%+v", devices)
+	}
+	if devices[0].LastSeenAtMs != now.Add(time.Minute).UnixMilli() {
+		t.Fatalf("ipad lastSeen: got=%d", devices[0].LastSeenAtMs)
+	}
+	if !devices[1].Revoked() {
+		t.Fatalf("iphone should be revoked: %+v", devices[1])
+	}
+
+	// A revoked name can be paired again with a fresh token.
+	if _, err := reg.Add("iphone", "tok_d", config.ScopeChat, now); err != nil {
+		t.Fatalf("Add(re-pair) error: %v", err)
+	}
+	d, err := reg.Get("iphone")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if d.Revoked() || d.Token != "tok_d" {
+		t.Fatalf("re-paired device: got=%+v", d)
+	}
+
+	info, err := os.Stat(reg.Path())
+	if err != nil {
+		t.Fatalf("stat devices: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("devices perms: got=%#o want=%#o", info.Mode().Perm(), 0o600)
+	}
+}
+
+func TestDeviceRegistry_ConcurrentTouchKeepsRevoke(t *testing.T) {
+	t.Parallel()
+
+	reg := config.DeviceRegistry{BaseDir: t.TempDir()}
+	now := time.UnixMilli(1_700_000_000_000)
+	for _, name := range []string{"ipad", "iphone"} {
+		if _, err := reg.Add(name, "tok_"+name, config.ScopeChat, now); err != nil {
+			t.Fatalf("Add(%s) error: %v", name, err)
+		}
+	}
+
+	// The agent keeps recording last-seen while the CLI revokes another device. Without the
+	// registry lock a touch that read the file before the revoke writes the device back.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := reg.Touch("ipad", now.Add(time.Duration(i*100+j)*time.Millisecond)); err != nil {
+					t.Errorf("Touch() error: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	if err := reg.Revoke("iphone", now); err != nil {
+		t.Fatalf("Revoke() error: %v", err)
+	}
+	wg.Wait()
+
+	d, err := reg.Get("iphone")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if !d.Revoked() {
+		t.Fatalf("iphone should stay revoked: %+v", d)
+	}
+}
+
+func TestDeviceRegistry_UnchangedUpdateDoesNotRewrite(t *testing.T) {
+	t.Parallel()
+
+	reg := config.DeviceRegistry{BaseDir: t.TempDir()}
+	now := time.UnixMilli(1_700_000_000_000)
+	if _, err := reg.Add("ipad", "tok_a", config.ScopeChat, now); err != nil {
+		t.Fatalf("Add() error: %v", err)
+	}
+	if err := reg.Touch("ipad", now); err != nil {
+		t.Fatalf("Touch() error: %v", err)
+	}
+	before, err := os.Stat(reg.Path())
+	if err != nil {
+		t.Fatalf("stat devices: %v", err)
+	}
+
+	if err := reg.Touch("ipad", now); err != nil {
+		t.Fatalf("Touch(same time) error: %v", err)
+	}
+	if err := reg.Touch("unknown", now); err != nil {
+		t.Fatalf("Touch(unknown) error: %v", err)
+	}
+	after, err := os.Stat(reg.Path())
+	if err != nil {
+		t.Fatalf("stat devices: %v", err)
+	}
+	// Writes replace the file, so an untouched file is still the same inode.
+	if !os.SameFile(before, after) {
+		t.Fatalf("devices.json was rewritten although nothing changed")
+	}
+}
+
+func TestDeviceRegistry_MigrateLegacyToken(t *testing.T) {
+	t.Parallel()
+
+	baseDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(baseDir, "token"), []byte("tok_legacy\n"), 0o600); err != nil {
+		t.Fatalf("write legacy token: %v", err)
+	}
+
+	reg := config.DeviceRegistry{BaseDir: baseDir}
+	migrated, err := reg.MigrateLegacyToken(time.Now())
+	if err != nil {
+		t.Fatalf("MigrateLegacyToken() error: %v", err)
+	}
+	if !migrated {
+		t.Fatalf("expected legacy token to be migrated")
+	}
+
+	d, err := reg.Get(config.DefaultDevice)
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if d.Token != "tok_legacy" {
+		t.Fatalf("token: got=%q want=%q", d.Token, "tok_legacy")
+	}
+	if d.EffectiveScope() != config.ScopeAdmin {
+		t.Fatalf("scope: got=%q want=%q", d.EffectiveScope(), config.ScopeAdmin)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "token")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("legacy token file should be removed: %v", err)
+	}
+}
+
+func TestValidateDeviceName(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"iphone", "Work-iPad_2", "a.b"} {
+		if err := config.ValidateDeviceName(name); err != nil {
+			t.Fatalf("ValidateDeviceName(%q) error: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "my phone", "../x"} {
+		if err := config.ValidateDeviceName(name); err == nil {
+			t.Fatalf("ValidateDeviceName(%q): expected error", name)
+		}
+	}
+}
+
+func TestScope_Allows(t *testing.T) {
+	t.Parallel()
+
+	if !config.ScopeAdmin.Allows(config.ScopeChat) || !config.ScopeChat.Allows(config.ScopeRead) {
+		t.Fatalf("higher scopes should include lower ones")
+	}
+	if config.ScopeRead.Allows(config.ScopeChat) || config.ScopeChat.Allows(config.ScopeAdmin) {
+		t.Fatalf("lower scopes should not include higher ones")
+	}
+	if _, err := config.ParseScope("owner"); err == nil {
+		t.Fatalf("ParseScope(owner): expected error")
+	}
+}
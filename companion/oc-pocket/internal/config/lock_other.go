@@ -0,0 +1,9 @@
+//go:build !unix
+
+package config
+
+// File locks are not available; concurrent writers are not serialized.
+
+func lockFile(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
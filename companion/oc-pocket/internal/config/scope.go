@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scope limits what a device token may do through the gateway. Scopes are ordered:
+// admin includes chat, and chat includes read.
+type Scope string
+
+const (
+	// ScopeRead can observe sessions but cannot change anything.
+	ScopeRead Scope = "read"
+	// ScopeChat can additionally send prompts, abort sessions and reply to permission requests.
+	ScopeChat Scope = "chat"
+	// ScopeAdmin has full access, including OpenCode configuration and terminals.
+	ScopeAdmin Scope = "admin"
+)
+
+func ParseScope(s string) (Scope, error) {
+	switch Scope(strings.TrimSpace(strings.ToLower(s))) {
+	case ScopeRead:
+		return ScopeRead, nil
+	case ScopeChat:
+		return ScopeChat, nil
+	case ScopeAdmin:
+		return ScopeAdmin, nil
+	default:
+		return "", fmt.Errorf("invalid scope %q (expected read|chat|admin)", s)
+	}
+}
+
+// Allows reports whether a token with scope s may perform an action requiring scope required.
+func (s Scope) Allows(required Scope) bool {
+	return s.rank() >= required.rank()
+}
+
+func (s Scope) rank() int {
+	switch s {
+	case ScopeRead:
+		return 1
+	case ScopeChat:
+		return 2
+	case ScopeAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/fsutil"
 )
 
 type Mode string
@@ -22,13 +24,37 @@ type Config struct {
 	OpenCodePort     int    `json:"openCodePort"`
 	OpenCodePath     string `json:"openCodePath"`
 	DefaultDirectory string `json:"defaultDirectory"`
+	// TLS makes the gateway serve HTTPS with a locally generated certificate whenever it is
+	// reachable directly (LAN mode, Tailscale-IP fallback) rather than through Tailscale Serve.
+	TLS bool `json:"tls,omitempty"`
+	// SSEHeartbeatSeconds is how often the gateway writes a heartbeat comment to idle event
+	// streams. Zero uses the gateway default; a negative value disables heartbeats.
+	SSEHeartbeatSeconds int `json:"sseHeartbeatSeconds,omitempty"`
+	// HoldTimeoutSeconds is how long the gateway holds requests while OpenCode restarts.
+	// Zero uses the gateway default; a negative value fails them immediately.
+	HoldTimeoutSeconds int `json:"holdTimeoutSeconds,omitempty"`
+	// ShutdownGraceSeconds is how long OpenCode gets to exit after SIGTERM before it is killed.
+	// Zero uses the agent default; a negative value kills it immediately.
+	ShutdownGraceSeconds int `json:"shutdownGraceSeconds,omitempty"`
+	// LogMaxSizeMB is the size at which the agent's log files are rotated. Zero uses the agent
+	// default; a negative value never rotates.
+	LogMaxSizeMB int `json:"logMaxSizeMB,omitempty"`
+	// LogKeep is how many rotated log segments are kept. Zero uses the agent default; a
+	// negative value keeps none.
+	LogKeep int `json:"logKeep,omitempty"`
+	// LogCompress gzips rotated log segments.
+	LogCompress bool `json:"logCompress,omitempty"`
+	// AccessLog makes the gateway write a JSON line per request to logs/access.log.
+	AccessLog bool `json:"accessLog,omitempty"`
+	// MetricsPort serves Prometheus metrics on 127.0.0.1 at this port. Zero disables them.
+	MetricsPort int `json:"metricsPort,omitempty"`
 }
 
 type Store struct {
 	BaseDir string
 }
 
-func (s Store) Save(cfg Config, token string) error {
+func (s Store) Save(cfg Config) error {
 	if s.BaseDir == "" {
 		return errors.New("BaseDir is required")
 	}
@@ -49,67 +75,35 @@ func (s Store) Save(cfg Config, token string) error {
 	}
 
 	configPath := filepath.Join(s.BaseDir, "config.json")
-	tokenPath := filepath.Join(s.BaseDir, "token")
 
 	raw, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
 		return err
 	}
-	if err := atomicWriteFile(configPath, raw, 0o600); err != nil {
+	if err := fsutil.AtomicWriteFile(configPath, raw, 0o600); err != nil {
 		return fmt.Errorf("write config: %w", err)
 	}
-	if err := atomicWriteFile(tokenPath, []byte(token), 0o600); err != nil {
-		return fmt.Errorf("write token: %w", err)
-	}
 	return nil
 }
 
-func (s Store) Load() (Config, string, error) {
+func (s Store) Load() (Config, error) {
 	if s.BaseDir == "" {
-		return Config{}, "", errors.New("BaseDir is required")
+		return Config{}, errors.New("BaseDir is required")
 	}
 	configPath := filepath.Join(s.BaseDir, "config.json")
-	tokenPath := filepath.Join(s.BaseDir, "token")
 
 	raw, err := os.ReadFile(configPath)
 	if err != nil {
-		return Config{}, "", err
+		return Config{}, err
 	}
 	var cfg Config
 	if err := json.Unmarshal(raw, &cfg); err != nil {
-		return Config{}, "", err
-	}
-
-	tokenRaw, err := os.ReadFile(tokenPath)
-	if err != nil {
-		return Config{}, "", err
+		return Config{}, err
 	}
-	return cfg, string(tokenRaw), nil
+	return cfg, nil
 }
 
-func atomicWriteFile(path string, contents []byte, perm os.FileMode) error {
-	dir := filepath.Dir(path)
-	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
-	if err != nil {
-		return err
-	}
-	tmpName := tmp.Name()
-	defer func() { _ = os.Remove(tmpName) }()
-
-	if err := tmp.Chmod(perm); err != nil {
-		_ = tmp.Close()
-		return err
-	}
-	if _, err := tmp.Write(contents); err != nil {
-		_ = tmp.Close()
-		return err
-	}
-	if err := tmp.Sync(); err != nil {
-		_ = tmp.Close()
-		return err
-	}
-	if err := tmp.Close(); err != nil {
-		return err
-	}
-	return os.Rename(tmpName, path)
+// Devices returns the device registry stored alongside the config.
+func (s Store) Devices() DeviceRegistry {
+	return DeviceRegistry{BaseDir: s.BaseDir}
 }
@@ -21,29 +21,24 @@ func TestStore_SaveLoad_RoundTrip(t *testing.T) {
 		OpenCodePath: "/usr/local/bin/opencode",
 		DefaultDirectory: "/Users/example/work",
 	}
-	token := "tok_test"
-
-	if err := store.Save(cfg, token); err != nil {
+	if err := store.Save(cfg); err != nil {
 		t.Fatalf("Save() error: %v", err)
 	}
 
-	gotCfg, gotToken, err := store.Load()
+	gotCfg, err := store.Load()
 	if err != nil {
 		t.Fatalf("Load() error: %v", err)
 	}
 	if gotCfg != cfg {
 		t.Fatalf("cfg mismatch: got=%+v want=%+v", gotCfg, cfg)
 	}
-	if gotToken != token {
-		t.Fatalf("token mismatch: got=%q want=%q", gotToken, token)
-	}
 
-	// Token should be stored in a strict-perms file.
-	info, err := os.Stat(filepath.Join(baseDir, "token"))
+	// Config should be stored in a strict-perms file.
+	info, err := os.Stat(filepath.Join(baseDir, "config.json"))
 	if err != nil {
-		t.Fatalf("stat token: %v", err)
+		t.Fatalf("stat config: %v", err)
 	}
 	if info.Mode().Perm() != 0o600 {
-		t.Fatalf("token perms: got=%#o want=%#o", info.Mode().Perm(), 0o600)
+		t.Fatalf("config perms: got=%#o want=%#o", info.Mode().Perm(), 0o600)
 	}
 }
@@ -0,0 +1,62 @@
+package control_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/control"
+)
+
+func TestClient_RoundTripOverSocket(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ln, err := control.Listen(control.SocketPath(dir))
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ping", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, http.StatusOK, map[string]string{"pong": "ok"})
+	})
+	mux.HandleFunc("DELETE /ping", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteError(w, http.StatusNotFound, "nothing to delete")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = control.Serve(ctx, ln, mux)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	client := control.NewClient(dir)
+	var out map[string]string
+	if err := client.Get(context.Background(), "/ping", &out); err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if out["pong"] != "ok" {
+		t.Fatalf("response: got=%v", out)
+	}
+
+	err = client.Do(context.Background(), http.MethodDelete, "/ping", nil)
+	if err == nil || err.Error() != "nothing to delete" {
+		t.Fatalf("Do(DELETE) error: got=%v want=%q", err, "nothing to delete")
+	}
+}
+
+func TestClient_NoAgent_ReturnsErrAgentNotRunning(t *testing.T) {
+	t.Parallel()
+
+	err := control.NewClient(t.TempDir()).Get(context.Background(), "/ping", nil)
+	if !errors.Is(err, control.ErrAgentNotRunning) {
+		t.Fatalf("Get() error: got=%v want=%v", err, control.ErrAgentNotRunning)
+	}
+}
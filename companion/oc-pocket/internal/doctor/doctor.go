@@ -0,0 +1,229 @@
+// Package doctor implements the checks behind `oc-pocket doctor`.
+//
+// Each check inspects one thing and returns a Check saying what it found and, for warnings and
+// failures, how to fix it. Checks never change anything.
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/tailscale"
+)
+
+type Result string
+
+const (
+	Pass Result = "pass"
+	Warn Result = "warn"
+	Fail Result = "fail"
+)
+
+// Check is the outcome of one diagnostic.
+type Check struct {
+	Name   string `json:"name"`
+	Result Result `json:"result"`
+	Detail string `json:"detail"`
+	// Fix says how to resolve a warning or failure.
+	Fix string `json:"fix,omitempty"`
+}
+
+func pass(name string, detail string) Check {
+	return Check{Name: name, Result: Pass, Detail: detail}
+}
+
+func warn(name string, detail string, fix string) Check {
+	return Check{Name: name, Result: Warn, Detail: detail, Fix: fix}
+}
+
+func fail(name string, detail string, fix string) Check {
+	return Check{Name: name, Result: Fail, Detail: detail, Fix: fix}
+}
+
+// Worst returns the most severe result among checks.
+func Worst(checks []Check) Result {
+	worst := Pass
+	for _, c := range checks {
+		switch {
+		case c.Result == Fail:
+			return Fail
+		case c.Result == Warn:
+			worst = Warn
+		}
+	}
+	return worst
+}
+
+// Permissions checks that path exists and grants nothing beyond max, e.g. 0o600 for a file
+// holding tokens.
+func Permissions(name string, path string, max os.FileMode) Check {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fail(name, err.Error(), "re-run `oc-pocket setup`")
+	}
+	perm := fi.Mode().Perm()
+	if extra := perm &^ max; extra != 0 {
+		return fail(name, fmt.Sprintf("%s is %04o; it must not be readable or writable by other users", path, perm),
+			fmt.Sprintf("chmod %04o %s", max, path))
+	}
+	return pass(name, fmt.Sprintf("%s is %04o", path, perm))
+}
+
+// OpenCode checks that the configured opencode binary is executable and reports its version.
+func OpenCode(ctx context.Context, path string) Check {
+	const name = "opencode binary"
+	fix := "install OpenCode, or re-run `oc-pocket setup --opencode-path <path>`"
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fail(name, err.Error(), fix)
+	}
+	if fi.IsDir() || fi.Mode()&0o111 == 0 {
+		return fail(name, path+" is not executable", fix)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return fail(name, fmt.Sprintf("`%s --version` failed: %v", path, err), fix)
+	}
+	version := strings.TrimSpace(string(out))
+	if i := strings.IndexByte(version, '\n'); i >= 0 {
+		version = version[:i]
+	}
+	return pass(name, path+" "+version)
+}
+
+// Port checks that nothing but the agent holds addr. agentRunning says whether the agent (and
+// the OpenCode it supervises) is expected to be listening there.
+func Port(name string, addr string, agentRunning bool) Check {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		_ = ln.Close()
+		if agentRunning {
+			return warn(name, addr+" is free although the agent is running", "check `oc-pocket status` for errors")
+		}
+		return pass(name, addr+" is free")
+	}
+	if agentRunning {
+		return pass(name, addr+" is in use by the agent")
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	return fail(name, fmt.Sprintf("%s is in use by another process: %v", addr, err),
+		fmt.Sprintf("find it with `lsof -nP -iTCP:%s -sTCP:LISTEN` and stop it, or pick other ports in config.json", port))
+}
+
+// Tailscale checks that Tailscale is logged in and that Serve proxies the gateway port.
+func Tailscale(ctx context.Context, ts tailscale.Client, gatewayPort int) []Check {
+	st, err := ts.GetStatus(ctx)
+	if err != nil {
+		return []Check{fail("tailscale login", err.Error(), "run `tailscale up`, then `oc-pocket restart`")}
+	}
+	checks := []Check{pass("tailscale login", fmt.Sprintf("logged in as %s (%s)", st.DNSName, st.IPv4))}
+
+	serving, err := ts.ServesPort(ctx, gatewayPort)
+	switch {
+	case err != nil:
+		checks = append(checks, warn("tailscale serve", err.Error(), "run `tailscale serve status`"))
+	case !serving:
+		checks = append(checks, warn("tailscale serve",
+			fmt.Sprintf("Tailscale Serve does not proxy to 127.0.0.1:%d; phones fall back to the tailnet IP", gatewayPort),
+			fmt.Sprintf("run `tailscale serve --bg %d`, then `oc-pocket restart`", gatewayPort)))
+	default:
+		checks = append(checks, pass("tailscale serve", fmt.Sprintf("https://%s proxies to 127.0.0.1:%d", st.DNSName, gatewayPort)))
+	}
+	return checks
+}
+
+// BaseURL checks the pairing base URL against iOS App Transport Security, which blocks plain
+// HTTP to anything but loopback in release builds.
+func BaseURL(baseURL string) Check {
+	const name = "pairing base URL"
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return fail(name, fmt.Sprintf("invalid base URL %q", baseURL), "re-run `oc-pocket setup`")
+	}
+	if u.Scheme == "https" {
+		return pass(name, baseURL)
+	}
+	if ip := net.ParseIP(u.Hostname()); (ip != nil && ip.IsLoopback()) || u.Hostname() == "localhost" {
+		return pass(name, baseURL+" (loopback; iOS Simulator only)")
+	}
+	return warn(name, baseURL+" is plain HTTP; iOS App Transport Security blocks it in release builds",
+		"enable Tailscale Serve or re-run `oc-pocket setup --tls`")
+}
+
+// ServiceDefinition compares the installed service definition (e.g. the LaunchAgent plist) with
+// what setup would write now.
+func ServiceDefinition(name string, path string, want []byte) Check {
+	have, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fail(name, path+" is missing", "re-run `oc-pocket setup`")
+	}
+	if err != nil {
+		return fail(name, err.Error(), "re-run `oc-pocket setup`")
+	}
+	if !bytes.Equal(have, want) {
+		return warn(name, path+" differs from what setup would write (moved binary or config dir?)", "re-run `oc-pocket setup`")
+	}
+	return pass(name, path+" is up to date")
+}
+
+// RoundTrip authenticates against the gateway at baseURL with token and fetches OpenCode's
+// config through it.
+func RoundTrip(ctx context.Context, client *http.Client, baseURL string, token string) Check {
+	const name = "gateway round-trip"
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	var whoami gateway.WhoAmI
+	if err := get(ctx, client, strings.TrimSuffix(baseURL, "/")+"/__oc-pocket/whoami", token, &whoami); err != nil {
+		return fail(name, "authenticating: "+err.Error(), "check `oc-pocket status` and `oc-pocket devices list`")
+	}
+	if err := get(ctx, client, strings.TrimSuffix(baseURL, "/")+"/config", token, nil); err != nil {
+		return fail(name, "fetching /config from OpenCode: "+err.Error(), "check `oc-pocket status` and the OpenCode logs")
+	}
+	return pass(name, fmt.Sprintf("%s as device %q (%s) in %s", baseURL, whoami.Device, whoami.Scope, time.Since(start).Round(time.Millisecond)))
+}
+
+func get(ctx context.Context, client *http.Client, url string, token string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e gateway.ErrorResponse
+		if json.Unmarshal(raw, &e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error.Message)
+		}
+		return errors.New(resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
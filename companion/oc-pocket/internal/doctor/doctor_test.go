@@ -0,0 +1,115 @@
+package doctor_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/doctor"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+func TestPermissions_FailsWhenOthersCanRead(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "devices.json")
+	if err := os.WriteFile(path, []byte("{}"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if c := doctor.Permissions("device tokens", path, 0o600); c.Result != doctor.Fail || !strings.Contains(c.Fix, "chmod 0600") {
+		t.Fatalf("0644: got=%+v", c)
+	}
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if c := doctor.Permissions("device tokens", path, 0o600); c.Result != doctor.Pass {
+		t.Fatalf("0600: got=%+v", c)
+	}
+}
+
+func TestPort_ReportsConflictsOnlyWhenTheAgentIsNotRunning(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	addr := ln.Addr().String()
+
+	if c := doctor.Port("gateway port", addr, false); c.Result != doctor.Fail {
+		t.Fatalf("taken, agent stopped: got=%+v", c)
+	}
+	if c := doctor.Port("gateway port", addr, true); c.Result != doctor.Pass {
+		t.Fatalf("taken, agent running: got=%+v", c)
+	}
+}
+
+func TestBaseURL_WarnsAboutPlainHTTP(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]doctor.Result{
+		"https://mac.tail1234.ts.net": doctor.Pass,
+		"http://127.0.0.1:4096":       doctor.Pass,
+		"http://192.168.1.23:4096":    doctor.Warn,
+		"not a url":                   doctor.Fail,
+	}
+	for baseURL, want := range cases {
+		if c := doctor.BaseURL(baseURL); c.Result != want {
+			t.Fatalf("%s: got=%+v want=%s", baseURL, c, want)
+		}
+	}
+}
+
+func TestServiceDefinition_ComparesWithExpectedRender(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "agent.plist")
+	if c := doctor.ServiceDefinition("plist", path, []byte("want")); c.Result != doctor.Fail {
+		t.Fatalf("missing: got=%+v", c)
+	}
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if c := doctor.ServiceDefinition("plist", path, []byte("want")); c.Result != doctor.Warn {
+		t.Fatalf("stale: got=%+v", c)
+	}
+	if c := doctor.ServiceDefinition("plist", path, []byte("old")); c.Result != doctor.Pass {
+		t.Fatalf("current: got=%+v", c)
+	}
+}
+
+func TestRoundTrip_AuthenticatesAndReachesOpenCode(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(gateway.ErrorResponse{Error: gateway.ErrorBody{Code: gateway.CodeTokenInvalid, Message: "invalid token"}})
+			return
+		}
+		switch r.URL.Path {
+		case "/__oc-pocket/whoami":
+			_ = json.NewEncoder(w).Encode(gateway.WhoAmI{Device: "phone", Scope: "chat"})
+		case "/config":
+			_, _ = w.Write([]byte("{}"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	if c := doctor.RoundTrip(context.Background(), srv.Client(), srv.URL, "good"); c.Result != doctor.Pass || !strings.Contains(c.Detail, `"phone"`) {
+		t.Fatalf("good token: got=%+v", c)
+	}
+	if c := doctor.RoundTrip(context.Background(), srv.Client(), srv.URL, "bad"); c.Result != doctor.Fail || !strings.Contains(c.Detail, "invalid token") {
+		t.Fatalf("bad token: got=%+v", c)
+	}
+}
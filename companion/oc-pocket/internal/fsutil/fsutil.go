@@ -0,0 +1,37 @@
+// Package fsutil holds file helpers shared by the packages that persist agent state.
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// AtomicWriteFile writes contents to path with mode perm, so that readers (and a crash) see
+// either the old file or the complete new one. The data is fsynced before it is renamed over
+// path.
+func AtomicWriteFile(path string, contents []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer func() { _ = os.Remove(tmpName) }()
+
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(contents); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,45 @@
+package fsutil_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/fsutil"
+)
+
+func TestAtomicWriteFile_ReplacesFileWithModeAndLeavesNoTemp(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.json")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	if err := fsutil.AtomicWriteFile(path, []byte("new"), 0o600); err != nil {
+		t.Fatalf("AtomicWriteFile() error: %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "new" {
+		t.Fatalf("contents: got=%q err=%v", got, err)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat() error: %v", err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Fatalf("mode: got=%o want=%o", perm, 0o600)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the target file, got %d entries", len(entries))
+	}
+}
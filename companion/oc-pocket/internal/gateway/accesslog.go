@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// AccessEntry is one line of the access log.
+type AccessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	// Device is the device that authenticated. TokenFingerprint identifies the bearer token
+	// when there is no device, e.g. a rejected token, without revealing it.
+	Device           string `json:"device,omitempty"`
+	TokenFingerprint string `json:"tokenFingerprint,omitempty"`
+	RemoteAddr       string `json:"remoteAddr"`
+	Method           string `json:"method"`
+	// Path is the route with IDs replaced by {id}, e.g. /session/{id}/message. Query is the
+	// query string with sensitive values scrubbed.
+	Path      string `json:"path"`
+	Query     string `json:"query,omitempty"`
+	Status    int    `json:"status"`
+	Bytes     int64  `json:"bytes"`
+	LatencyMs int64  `json:"latencyMs"`
+	// StreamMs is how long an event stream stayed open.
+	StreamMs *int64 `json:"streamMs,omitempty"`
+}
+
+// requestIDHeader carries the access log's request ID back to the client.
+const requestIDHeader = "X-Request-Id"
+
+// sensitiveParams are query parameters whose values are never logged.
+var sensitiveParams = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"auth":          true,
+	"authorization": true,
+	"key":           true,
+	"api_key":       true,
+	"apikey":        true,
+	"password":      true,
+	"secret":        true,
+	"signature":     true,
+}
+
+// accessLog writes an AccessEntry per request as a JSON line.
+type accessLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// trustForwarded is Options.TrustForwardedFor.
+	trustForwarded bool
+}
+
+func newAccessLog(w io.Writer, trustForwarded bool) *accessLog {
+	return &accessLog{enc: json.NewEncoder(w), trustForwarded: trustForwarded}
+}
+
+type accessDeviceKey struct{}
+
+// setAccessDevice records the authenticated device for the access log entry of the request.
+func setAccessDevice(ctx context.Context, device string) {
+	if p, ok := ctx.Value(accessDeviceKey{}).(*string); ok {
+		*p = device
+	}
+}
+
+func (l *accessLog) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := newRequestID()
+		w.Header().Set(requestIDHeader, id)
+
+		var device string
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessDeviceKey{}, &device)))
+		end := time.Now()
+
+		e := AccessEntry{
+			Time:       start.UTC(),
+			RequestID:  id,
+			Device:     device,
+			RemoteAddr: remoteIP(r, l.trustForwarded),
+			Method:     r.Method,
+			Path:       pathTemplate(r.URL.EscapedPath()),
+			Query:      scrubQuery(r.URL.Query()),
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			LatencyMs:  end.Sub(start).Milliseconds(),
+		}
+		if e.Device == "" {
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+				e.TokenFingerprint = tokenFingerprint(token)
+			}
+		}
+		if e.Status == 0 {
+			// Nothing was written; net/http answers 200.
+			e.Status = http.StatusOK
+		}
+		if rec.streaming {
+			// Latency is the time to the response headers; the rest is the stream.
+			e.LatencyMs = rec.headerAt.Sub(start).Milliseconds()
+			stream := end.Sub(rec.headerAt).Milliseconds()
+			e.StreamMs = &stream
+		}
+
+		l.mu.Lock()
+		_ = l.enc.Encode(e)
+		l.mu.Unlock()
+	})
+}
+
+// accessRecorder captures what the access log needs from a response.
+type accessRecorder struct {
+	http.ResponseWriter
+
+	mu        sync.Mutex
+	status    int
+	bytes     int64
+	headerAt  time.Time
+	streaming bool
+	// onStream, if set, is called when the response turns out to be an event stream.
+	onStream func()
+}
+
+func (w *accessRecorder) WriteHeader(code int) {
+	w.mu.Lock()
+	if w.status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+		w.headersWrittenLocked()
+	}
+	w.mu.Unlock()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessRecorder) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.headersWrittenLocked()
+	}
+	w.mu.Unlock()
+	n, err := w.ResponseWriter.Write(p)
+	w.mu.Lock()
+	w.bytes += int64(n)
+	w.mu.Unlock()
+	return n, err
+}
+
+func (w *accessRecorder) headersWrittenLocked() {
+	w.headerAt = time.Now()
+	w.streaming = isEventStream(w.Header().Get("Content-Type"))
+	if w.streaming && w.onStream != nil {
+		w.onStream()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer to flush and hijack.
+func (w *accessRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func newRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// tokenFingerprint is a short hash of a token, enough to tell tokens apart in logs.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// pathTemplate replaces the IDs in an escaped path with {id} so entries for the same route
+// group together and logs do not collect session or file IDs.
+func pathTemplate(p string) string {
+	segments := splitPath(p)
+	for i, seg := range segments {
+		if isIDSegment(seg) {
+			segments[i] = "{id}"
+		} else {
+			segments[i] = url.PathEscape(seg)
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// isIDSegment reports whether a path segment looks like an identifier rather than a route
+// name. OpenCode's IDs (ses_..., msg_..., per_...) and UUIDs all contain digits; route names
+// do not.
+func isIDSegment(seg string) bool {
+	return len(seg) > 32 || strings.IndexFunc(seg, unicode.IsDigit) >= 0
+}
+
+// scrubQuery encodes the query with the values of sensitive parameters replaced.
+func scrubQuery(q url.Values) string {
+	for key, values := range q {
+		if sensitiveParams[strings.ToLower(key)] {
+			for i := range values {
+				values[i] = "REDACTED"
+			}
+		}
+	}
+	return q.Encode()
+}
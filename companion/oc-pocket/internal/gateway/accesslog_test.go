@@ -0,0 +1,127 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestGateway_AccessLog_RecordsDeviceRouteAndStreams(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/event" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprint(w, "data: one\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	var log lockedBuffer
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   upstream.URL,
+		Auth:       mapAuth{"tok_phone": {Device: "iphone", Scope: config.ScopeChat}},
+		AccessLog:  &log,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	do := func(path string, token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", gw.BaseURL()+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do(%s) error: %v", path, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp
+	}
+	resp := do("/session/ses_4f2a9c/message?directory=/repo&token=secret", "tok_phone")
+	do("/config", "tok_wrong")
+	do("/event", "tok_phone")
+
+	var entries []gateway.AccessEntry
+	deadline := time.Now().Add(2 * time.Second)
+	for len(entries) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		entries = entries[:0]
+		for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+			var e gateway.AccessEntry
+			if json.Unmarshal([]byte(line), &e) == nil {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if len(entries) != 3 {
+		t.Fatalf("entries: got=%q", log.String())
+	}
+	if strings.Contains(log.String(), "secret") || strings.Contains(log.String(), "tok_") {
+		t.Fatalf("credentials leaked into the access log: %q", log.String())
+	}
+
+	prompt := entries[0]
+	if prompt.Device != "iphone" || prompt.Path != "/session/{id}/message" || prompt.Status != http.StatusOK || prompt.Bytes != 5 {
+		t.Fatalf("prompt entry: got=%+v", prompt)
+	}
+	if prompt.Query != "directory=%2Frepo&token=REDACTED" {
+		t.Fatalf("query: got=%q", prompt.Query)
+	}
+	if prompt.RequestID == "" || prompt.RequestID != resp.Header.Get("X-Request-Id") {
+		t.Fatalf("request ID: entry=%q header=%q", prompt.RequestID, resp.Header.Get("X-Request-Id"))
+	}
+
+	rejected := entries[1]
+	if rejected.Device != "" || !strings.HasPrefix(rejected.TokenFingerprint, "sha256:") || rejected.Status != http.StatusUnauthorized {
+		t.Fatalf("rejected entry: got=%+v", rejected)
+	}
+
+	stream := entries[2]
+	if stream.StreamMs == nil || *stream.StreamMs < 50 {
+		t.Fatalf("stream entry: got=%+v", stream)
+	}
+	if prompt.StreamMs != nil {
+		t.Fatalf("non-stream entry has a stream duration: %+v", prompt)
+	}
+}
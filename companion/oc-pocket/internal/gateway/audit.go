@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+)
+
+// AuditEvent describes a state-changing request. It is reported to Options.Audit once the
+// response has been sent.
+type AuditEvent struct {
+	Time   time.Time
+	Device string
+	// Action names what was done, e.g. "prompt" or "permission_reply".
+	Action  string
+	Method  string
+	Path    string
+	Session string
+	// Directory is the project OpenCode was asked to act on, if the client named one.
+	Directory string
+	// BodySHA256 is the hex SHA-256 of the request body as forwarded to OpenCode. It is empty
+	// if the request failed before its body was read to the end, e.g. because OpenCode was
+	// not ready; BodyBytes then counts what was read.
+	BodySHA256 string
+	BodyBytes  int64
+	// Status is the response status, 0 if the client went away before one was sent. Error
+	// holds the start of the response body when the request failed.
+	Status int
+	Error  string
+}
+
+// auditRule names the action of an audited route. Patterns match like scopeRules.
+type auditRule struct {
+	method  string
+	pattern string
+	action  string
+}
+
+var auditRules = []auditRule{
+	{http.MethodPost, "/session/*/message", "prompt"},
+	{http.MethodPost, "/session/*/prompt_async", "prompt"},
+	{http.MethodPost, "/session/*/command", "command"},
+	{http.MethodPost, "/session/*/shell", "shell"},
+	{http.MethodPost, "/session/*/abort", "abort"},
+	{http.MethodPost, "/session/*/revert", "revert"},
+	{http.MethodPost, "/session/*/unrevert", "unrevert"},
+	{http.MethodPost, "/session/*/fork", "fork"},
+	{http.MethodPost, "/session/*/permissions/*", "permission_reply"},
+	{http.MethodPost, "/permission/*/reply", "permission_reply"},
+}
+
+// maxAuditError bounds how much of a failed response is kept in the audit log.
+const maxAuditError = 512
+
+// auditAction returns the action and session of an audited request. path is escaped, as for
+// requiredScope.
+func auditAction(method string, path string) (action string, session string, ok bool) {
+	segments := splitPath(path)
+	for _, rule := range auditRules {
+		if rule.method != method || !matchSegments(splitPath(rule.pattern), segments) {
+			continue
+		}
+		if segments[0] == "session" {
+			session = segments[1]
+		}
+		return rule.action, session, true
+	}
+	return "", "", false
+}
+
+// audited reports the request to Options.Audit after next has served it.
+func (s *Server) audited(next http.Handler, device string, action string, session string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := AuditEvent{
+			Time:      time.Now(),
+			Device:    device,
+			Action:    action,
+			Method:    r.Method,
+			Path:      r.URL.EscapedPath(),
+			Session:   session,
+			Directory: r.URL.Query().Get("directory"),
+		}
+		if ev.Directory == "" {
+			ev.Directory = r.Header.Get("X-Opencode-Directory")
+		}
+
+		body := &digestReader{ReadCloser: r.Body, h: sha256.New()}
+		hasBody := r.Body != nil && r.Body != http.NoBody
+		if hasBody {
+			r.Body = body
+		}
+		rec := &auditRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if !hasBody || body.eof {
+			ev.BodySHA256 = hex.EncodeToString(body.h.Sum(nil))
+		}
+		ev.BodyBytes = body.n
+		ev.Status = rec.status
+		if rec.status >= http.StatusBadRequest {
+			ev.Error = string(rec.errBody)
+		}
+		s.opts.Audit(ev)
+	})
+}
+
+// digestReader hashes a request body as it is read.
+type digestReader struct {
+	io.ReadCloser
+	h hash.Hash
+	n int64
+	// eof is set once the whole body has been read.
+	eof bool
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// auditRecorder keeps the status and, for failures, the start of the body.
+type auditRecorder struct {
+	http.ResponseWriter
+	status  int
+	errBody []byte
+}
+
+func (w *auditRecorder) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= http.StatusBadRequest && len(w.errBody) < maxAuditError {
+		w.errBody = append(w.errBody, p[:min(len(p), maxAuditError-len(w.errBody))]...)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *auditRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
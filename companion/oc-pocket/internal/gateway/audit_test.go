@@ -0,0 +1,158 @@
+package gateway_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+func TestGateway_Audit_RecordsMutatingActions(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if strings.HasSuffix(r.URL.Path, "/abort") {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	var mu sync.Mutex
+	var events []gateway.AuditEvent
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   upstream.URL,
+		Auth:       mapAuth{"tok_phone": {Device: "iphone", Scope: config.ScopeChat}},
+		Audit: func(ev gateway.AuditEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, ev)
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	body := `{"parts":[{"type":"text","text":"rm -rf build"}]}`
+	for _, req := range []struct{ method, path, body string }{
+		{"POST", "/session/ses_1/message?directory=/repo", body},
+		{"GET", "/session/ses_1/message", ""},
+		{"POST", "/session/ses_1/abort", ""},
+	} {
+		r, _ := http.NewRequest(req.method, gw.BaseURL()+req.path, strings.NewReader(req.body))
+		r.Header.Set("Authorization", "Bearer tok_phone")
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("Do(%s %s) error: %v", req.method, req.path, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	// Events are reported after the response is sent.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 {
+		t.Fatalf("events: got=%+v", events)
+	}
+
+	byAction := map[string]gateway.AuditEvent{}
+	for _, ev := range events {
+		byAction[ev.Action] = ev
+	}
+
+	sum := sha256.Sum256([]byte(body))
+	prompt := byAction["prompt"]
+	if prompt.Device != "iphone" || prompt.Action != "prompt" || prompt.Session != "ses_1" || prompt.Directory != "/repo" || prompt.Status != http.StatusOK {
+		t.Fatalf("prompt: got=%+v", prompt)
+	}
+	if prompt.BodySHA256 != hex.EncodeToString(sum[:]) || prompt.BodyBytes != int64(len(body)) {
+		t.Fatalf("prompt digest: got=%s (%d bytes)", prompt.BodySHA256, prompt.BodyBytes)
+	}
+
+	abort := byAction["abort"]
+	if abort.Status != http.StatusNotFound || !strings.Contains(abort.Error, "session not found") {
+		t.Fatalf("abort: got=%+v", abort)
+	}
+}
+
+func TestGateway_Audit_NoDigestWhenBodyWasNotForwarded(t *testing.T) {
+	t.Parallel()
+
+	events := make(chan gateway.AuditEvent, 1)
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   "http://127.0.0.1:1",
+		Auth:       mapAuth{"tok_phone": {Device: "iphone", Scope: config.ScopeChat}},
+		UpstreamStatus: func() gateway.UpstreamStatus {
+			return gateway.UpstreamStatus{State: gateway.UpstreamStarting}
+		},
+		AwaitUpstream: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		HoldTimeout: 50 * time.Millisecond,
+		Audit:       func(ev gateway.AuditEvent) { events <- ev },
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	r, _ := http.NewRequest("POST", gw.BaseURL()+"/session/ses_1/message", strings.NewReader(`{"parts":[]}`))
+	r.Header.Set("Authorization", "Bearer tok_phone")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatalf("Do() error: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status: got=%d want=%d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Action != "prompt" || ev.Status != http.StatusServiceUnavailable {
+			t.Fatalf("event: got=%+v", ev)
+		}
+		if ev.BodySHA256 != "" || ev.BodyBytes != 0 {
+			t.Fatalf("digest of a body that was never forwarded: got=%q (%d bytes)", ev.BodySHA256, ev.BodyBytes)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no audit event")
+	}
+}
@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Clients on slow links can opt in to coalescing with ?coalesce=250ms or the equivalent
+// header: consecutive message.part.updated events for the same part within the window are
+// merged into one.
+const (
+	coalesceParam  = "coalesce"
+	coalesceHeader = "X-OC-Pocket-Coalesce"
+
+	maxCoalesceWindow = 2 * time.Second
+	partUpdatedType   = "message.part.updated"
+)
+
+func parseCoalesceWindow(r *http.Request) (time.Duration, error) {
+	raw := r.URL.Query().Get(coalesceParam)
+	if raw == "" {
+		raw = r.Header.Get(coalesceHeader)
+	}
+	if raw = strings.TrimSpace(raw); raw == "" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(raw)
+	if err != nil || window < 0 || window > maxCoalesceWindow {
+		return 0, fmt.Errorf("%s must be a duration between 0 and %s", coalesceParam, maxCoalesceWindow)
+	}
+	return window, nil
+}
+
+// partCoalescer merges streaming part updates for one client. It holds at most one pending
+// part: any other event flushes it first, so the order of events is preserved and non-delta
+// events (permission requests, session status, ...) are never delayed behind a window.
+//
+// A nil *partCoalescer passes every event through.
+type partCoalescer struct {
+	window time.Duration
+
+	pending *globalEvent
+	merged  int
+	delta   strings.Builder
+	// deltaOK is false once a merged update had no delta; the latest part is then
+	// authoritative and the merged event carries no delta.
+	deltaOK bool
+	timer   *time.Timer
+}
+
+func newPartCoalescer(window time.Duration) *partCoalescer {
+	if window <= 0 {
+		return nil
+	}
+	return &partCoalescer{window: window}
+}
+
+// add returns the events that should be written now.
+func (c *partCoalescer) add(e globalEvent) []globalEvent {
+	if c == nil {
+		return []globalEvent{e}
+	}
+	if e.typ != partUpdatedType || e.partID == "" {
+		return append(c.flush(), e)
+	}
+	if c.pending != nil && c.pending.partID == e.partID {
+		c.pending = &e
+		c.merged++
+		c.addDelta(e)
+		return nil
+	}
+
+	out := c.flush()
+	c.pending = &e
+	c.merged = 1
+	c.delta.Reset()
+	c.deltaOK = true
+	c.addDelta(e)
+	c.timer = time.NewTimer(c.window)
+	return out
+}
+
+func (c *partCoalescer) addDelta(e globalEvent) {
+	if !e.hasDelta {
+		c.deltaOK = false
+		return
+	}
+	c.delta.WriteString(e.delta)
+}
+
+// expired is closed when the pending part's window ends; nil when nothing is pending.
+func (c *partCoalescer) expired() <-chan time.Time {
+	if c == nil || c.pending == nil {
+		return nil
+	}
+	return c.timer.C
+}
+
+// flush returns the pending part, if any, as a single event.
+func (c *partCoalescer) flush() []globalEvent {
+	if c == nil || c.pending == nil {
+		return nil
+	}
+	c.timer.Stop()
+	e := *c.pending
+	if c.merged > 1 {
+		e.data = withDelta(e.data, c.delta.String(), c.deltaOK)
+	}
+	c.pending = nil
+	return []globalEvent{e}
+}
+
+// withDelta rewrites payload.properties.delta of a part update, keeping every other field.
+func withDelta(data []byte, delta string, ok bool) []byte {
+	var envelope, payload, properties map[string]json.RawMessage
+	if json.Unmarshal(data, &envelope) != nil ||
+		json.Unmarshal(envelope["payload"], &payload) != nil ||
+		json.Unmarshal(payload["properties"], &properties) != nil {
+		return data
+	}
+	if ok {
+		properties["delta"], _ = json.Marshal(delta)
+	} else {
+		delete(properties, "delta")
+	}
+
+	var err error
+	if payload["properties"], err = json.Marshal(properties); err != nil {
+		return data
+	}
+	if envelope["payload"], err = json.Marshal(payload); err != nil {
+		return data
+	}
+	out, err := json.Marshal(envelope)
+	if err != nil {
+		return data
+	}
+	return out
+}
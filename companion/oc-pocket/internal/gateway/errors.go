@@ -0,0 +1,114 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ErrorCode is a stable, machine-readable reason for a gateway error. The app switches on it
+// to show precise guidance; messages are for humans and may change.
+type ErrorCode string
+
+const (
+	// CodeUpstreamStarting means OpenCode is starting and not accepting requests yet.
+	CodeUpstreamStarting ErrorCode = "upstream_starting"
+	// CodeUpstreamCrashed means OpenCode exited and is waiting to be restarted, or kept
+	// crashing and is not restarted anymore (no retry hint then).
+	CodeUpstreamCrashed ErrorCode = "upstream_crashed"
+	// CodeUpstreamError means OpenCode is running but the request to it failed.
+	CodeUpstreamError ErrorCode = "upstream_error"
+	CodeTokenRevoked  ErrorCode = "token_revoked"
+	CodeTokenInvalid  ErrorCode = "token_invalid"
+	// CodeForbiddenScope means the device's token lacks the scope the request needs.
+	CodeForbiddenScope ErrorCode = "forbidden_scope"
+	// CodeRateLimited means the remote IP is banned after repeated authentication failures.
+	CodeRateLimited      ErrorCode = "rate_limited"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeBadRequest       ErrorCode = "bad_request"
+	CodeInternalError    ErrorCode = "internal_error"
+)
+
+// ErrorResponse is the JSON body of every error the gateway itself returns.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// RetryAfterMs is set when retrying later is expected to succeed. The Retry-After header
+	// carries the same hint in whole seconds.
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, code ErrorCode, msg string, retryAfter time.Duration) {
+	body := ErrorBody{Code: code, Message: msg}
+	if retryAfter > 0 {
+		body.RetryAfterMs = retryAfter.Milliseconds()
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	}
+	writeJSON(w, status, ErrorResponse{Error: body})
+}
+
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrTokenRevoked) {
+		writeError(w, http.StatusUnauthorized, CodeTokenRevoked, "this device's token has been revoked; pair the device again", 0)
+		return
+	}
+	writeError(w, http.StatusUnauthorized, CodeTokenInvalid, "missing or invalid token", 0)
+}
+
+func writeLockedOut(w http.ResponseWriter, retryAfter time.Duration) {
+	writeError(w, http.StatusTooManyRequests, CodeRateLimited, "too many failed authentication attempts; try again later", retryAfter)
+}
+
+func writeForbidden(w http.ResponseWriter, msg string) {
+	writeError(w, http.StatusForbidden, CodeForbiddenScope, msg, 0)
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, CodeNotFound, "not found", 0)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed", 0)
+}
+
+// writeUpstreamError explains a failed proxy request using what the supervisor knows about
+// OpenCode.
+func (s *Server) writeUpstreamError(w http.ResponseWriter, err error) {
+	fail := func(status int, code ErrorCode, msg string, retryAfter time.Duration) {
+		s.metrics.upstreamError(code)
+		writeError(w, status, code, msg, retryAfter)
+	}
+	st := s.upstreamStatus()
+	switch {
+	case st.State == UpstreamCrashed:
+		msg := "OpenCode exited and is being restarted"
+		if st.LastError != "" {
+			msg += ": " + st.LastError
+		}
+		fail(http.StatusServiceUnavailable, CodeUpstreamCrashed, msg, max(st.RetryAfter, time.Second))
+	case st.State == UpstreamStopped:
+		msg := "OpenCode keeps crashing and is no longer restarted automatically; an admin can restart it"
+		if st.LastError != "" {
+			msg = st.LastError
+		}
+		fail(http.StatusServiceUnavailable, CodeUpstreamCrashed, msg, 0)
+	case st.State == UpstreamStarting:
+		fail(http.StatusServiceUnavailable, CodeUpstreamStarting, "OpenCode is starting", max(st.RetryAfter, time.Second))
+	case errors.Is(err, syscall.ECONNREFUSED):
+		// Nothing listening although OpenCode should be up: it most likely just went away.
+		if st.State == UpstreamRunning {
+			fail(http.StatusServiceUnavailable, CodeUpstreamCrashed, "OpenCode is not accepting connections", time.Second)
+		} else {
+			fail(http.StatusServiceUnavailable, CodeUpstreamStarting, "OpenCode is not accepting connections yet", time.Second)
+		}
+	default:
+		fail(http.StatusBadGateway, CodeUpstreamError, "request to OpenCode failed", 0)
+	}
+}
@@ -0,0 +1,193 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/control"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+type authFunc func(token string) (gateway.Principal, error)
+
+func (f authFunc) Authenticate(token string) (gateway.Principal, error) {
+	return f(token)
+}
+
+func TestGateway_ErrorsAreJSONWithStableCodes(t *testing.T) {
+	t.Parallel()
+
+	// Nothing listens on the upstream address, so proxied requests fail to connect.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	var upstream atomic.Value
+	upstream.Store(gateway.UpstreamStatus{State: gateway.UpstreamCrashed, RetryAfter: 2500 * time.Millisecond, LastError: "exited: exit status 1"})
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   closed.URL,
+		Auth: authFunc(func(token string) (gateway.Principal, error) {
+			switch token {
+			case "tok_read":
+				return gateway.Principal{Device: "ipad", Scope: config.ScopeRead}, nil
+			case "tok_revoked":
+				return gateway.Principal{}, gateway.ErrTokenRevoked
+			}
+			return gateway.Principal{}, gateway.ErrInvalidToken
+		}),
+		Lockout: gateway.NewLockout(gateway.LockoutPolicy{
+			MaxFailures: 3,
+			BanDuration: time.Minute,
+			Window:      time.Minute,
+		}),
+		UpstreamStatus: func() gateway.UpstreamStatus { return upstream.Load().(gateway.UpstreamStatus) },
+		HoldTimeout:    -1,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	do := func(method string, token string) (int, http.Header, gateway.ErrorBody) {
+		t.Helper()
+		req, _ := http.NewRequest(method, gw.BaseURL()+"/session", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do() error: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%s (%s): content type %q", method, token, ct)
+		}
+		var body gateway.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode error body: %v", err)
+		}
+		return resp.StatusCode, resp.Header, body.Error
+	}
+
+	cases := []struct {
+		method string
+		token  string
+		status int
+		code   gateway.ErrorCode
+	}{
+		{"GET", "tok_wrong", http.StatusUnauthorized, gateway.CodeTokenInvalid},
+		{"GET", "tok_revoked", http.StatusUnauthorized, gateway.CodeTokenRevoked},
+		{"POST", "tok_read", http.StatusForbidden, gateway.CodeForbiddenScope},
+	}
+	for _, tc := range cases {
+		status, _, body := do(tc.method, tc.token)
+		if status != tc.status || body.Code != tc.code || body.Message == "" {
+			t.Fatalf("%s (%s): got=%d %+v want=%d %s", tc.method, tc.token, status, body, tc.status, tc.code)
+		}
+	}
+
+	status, header, body := do("GET", "tok_read")
+	if status != http.StatusServiceUnavailable || body.Code != gateway.CodeUpstreamCrashed {
+		t.Fatalf("crashed upstream: got=%d %+v", status, body)
+	}
+	if body.RetryAfterMs != 2500 || header.Get("Retry-After") != "3" {
+		t.Fatalf("crashed retry hint: body=%d header=%q", body.RetryAfterMs, header.Get("Retry-After"))
+	}
+
+	upstream.Store(gateway.UpstreamStatus{State: gateway.UpstreamStarting, RetryAfter: time.Second})
+	if status, _, body := do("GET", "tok_read"); status != http.StatusServiceUnavailable || body.Code != gateway.CodeUpstreamStarting || body.RetryAfterMs != 1000 {
+		t.Fatalf("starting upstream: got=%d %+v", status, body)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, _, _ = do("GET", "tok_wrong")
+	}
+	if status, header, body := do("GET", "tok_read"); status != http.StatusTooManyRequests || body.Code != gateway.CodeRateLimited || body.RetryAfterMs <= 0 || header.Get("Retry-After") == "" {
+		t.Fatalf("banned: got=%d %+v", status, body)
+	}
+}
+
+func TestGateway_AdminAPI_ErrorsUseEnvelope(t *testing.T) {
+	t.Parallel()
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("GET /lockouts", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, http.StatusOK, []string{})
+	})
+	admin.HandleFunc("DELETE /lockouts", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteError(w, http.StatusBadRequest, "ip or all=1 is required")
+	})
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   "http://127.0.0.1:1",
+		Auth:       mapAuth{"tok_admin": {Device: "phone", Scope: config.ScopeAdmin}},
+		Admin:      admin,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	cases := []struct {
+		method string
+		path   string
+		status int
+		code   gateway.ErrorCode
+		msg    string
+	}{
+		{"GET", "/__oc-pocket/admin/nope", http.StatusNotFound, gateway.CodeNotFound, "not found"},
+		{"POST", "/__oc-pocket/admin/lockouts", http.StatusMethodNotAllowed, gateway.CodeMethodNotAllowed, "method not allowed"},
+		{"DELETE", "/__oc-pocket/admin/lockouts", http.StatusBadRequest, gateway.CodeBadRequest, "ip or all=1 is required"},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, gw.BaseURL()+tc.path, nil)
+		req.Header.Set("Authorization", "Bearer tok_admin")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s error: %v", tc.method, tc.path, err)
+		}
+		var body gateway.ErrorResponse
+		decodeErr := json.NewDecoder(resp.Body).Decode(&body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s %s: status got=%d want=%d", tc.method, tc.path, resp.StatusCode, tc.status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%s %s: content type got=%q", tc.method, tc.path, ct)
+		}
+		if decodeErr != nil || body.Error.Code != tc.code || body.Error.Message != tc.msg {
+			t.Fatalf("%s %s: body got=%+v (%v) want code=%s message=%q", tc.method, tc.path, body, decodeErr, tc.code, tc.msg)
+		}
+	}
+
+	// Successful responses pass through unchanged.
+	req, _ := http.NewRequest("GET", gw.BaseURL()+"/__oc-pocket/admin/lockouts", nil)
+	req.Header.Set("Authorization", "Bearer tok_admin")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET lockouts error: %v", err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(raw)) != "[]" {
+		t.Fatalf("GET lockouts: got=%d %q", resp.StatusCode, string(raw))
+	}
+}
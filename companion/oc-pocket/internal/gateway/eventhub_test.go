@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEventHub_FansOutAndDropsSlowClients(t *testing.T) {
+	hub := newEventHub("http://127.0.0.1:1", 10, time.UnixMilli(1))
+
+	aborted := false
+	fast, _, _ := hub.addClient(eventFilter{}, 0, false, func() {})
+	slow, _, _ := hub.addClient(eventFilter{}, 0, false, func() { aborted = true })
+	if n := hub.clientCount(); n != 2 {
+		t.Fatalf("clients: got=%d want=2", n)
+	}
+
+	for i := 0; i <= clientQueueSize; i++ {
+		hub.publish([]byte(fmt.Sprintf(`{"payload":{"type":"session.updated","properties":{"n":%d}}}`, i)))
+		// The fast client keeps up.
+		select {
+		case e := <-fast.events:
+			if e.typ != "session.updated" {
+				t.Fatalf("event type: got=%q", e.typ)
+			}
+		default:
+			t.Fatalf("event %d was not delivered to the fast client", i)
+		}
+	}
+
+	select {
+	case <-slow.dropped:
+	default:
+		t.Fatalf("slow client should have been dropped once its queue was full")
+	}
+	if !aborted {
+		t.Fatalf("dropping a client should abort its pending write")
+	}
+	select {
+	case <-fast.dropped:
+		t.Fatalf("fast client must not be dropped")
+	default:
+	}
+	if n := hub.clientCount(); n != 1 {
+		t.Fatalf("clients after drop: got=%d want=1", n)
+	}
+}
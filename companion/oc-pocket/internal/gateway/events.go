@@ -0,0 +1,412 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	globalEventPath = "/global/event"
+
+	// DefaultEventBufferSize is how many global events are kept for Last-Event-ID replay.
+	DefaultEventBufferSize = 1000
+
+	// clientQueueSize is how many events may be waiting for one client. A client that falls
+	// further behind is dropped and catches up through Last-Event-ID replay when it reconnects.
+	clientQueueSize = 256
+)
+
+// resyncEvent tells a reconnecting client that events were lost (the buffer wrapped or the
+// agent restarted) and it should refetch state instead of relying on the replay.
+var resyncEvent = []byte(`{"directory":"","payload":{"type":"oc-pocket.resync","properties":{"reason":"events_lost"}}}`)
+
+// connectedEvent greets every client, as OpenCode does for each of its own subscribers.
+var connectedEvent = []byte(`{"directory":"","payload":{"type":"server.connected","properties":{}}}`)
+
+// globalEvent is one upstream global event with the ID assigned by the gateway.
+type globalEvent struct {
+	id        uint64
+	data      []byte
+	directory string
+	typ       string
+
+	// For message.part.updated: the part and the text appended by this update, if any.
+	partID   string
+	delta    string
+	hasDelta bool
+}
+
+// eventRing is a fixed-size buffer of the most recent events. IDs in the ring are contiguous.
+type eventRing struct {
+	events []globalEvent
+	start  int
+	n      int
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]globalEvent, size)}
+}
+
+func (r *eventRing) add(e globalEvent) {
+	if r.n < len(r.events) {
+		r.events[(r.start+r.n)%len(r.events)] = e
+		r.n++
+		return
+	}
+	r.events[r.start] = e
+	r.start = (r.start + 1) % len(r.events)
+}
+
+func (r *eventRing) at(i int) globalEvent {
+	return r.events[(r.start+i)%len(r.events)]
+}
+
+// after returns the buffered events with IDs greater than lastID. ok is false when events
+// after lastID are no longer (or were never) in the buffer; the result then holds everything
+// that is buffered.
+func (r *eventRing) after(lastID uint64, nextID uint64) (events []globalEvent, ok bool) {
+	if lastID >= nextID {
+		// Issued by an earlier agent process.
+		return r.slice(0), false
+	}
+	if r.n == 0 {
+		return nil, lastID == nextID-1
+	}
+	first := r.at(0).id
+	if lastID+1 < first {
+		return r.slice(0), false
+	}
+	return r.slice(int(lastID + 1 - first)), true
+}
+
+func (r *eventRing) slice(from int) []globalEvent {
+	if from >= r.n {
+		return nil
+	}
+	out := make([]globalEvent, 0, r.n-from)
+	for i := from; i < r.n; i++ {
+		out = append(out, r.at(i))
+	}
+	return out
+}
+
+// eventHub keeps a single subscription to OpenCode's /global/event and fans it out to every
+// connected client. Events are numbered and the most recent ones are buffered so clients that
+// reconnect with Last-Event-ID miss nothing.
+//
+// Each client has a bounded queue. publish never blocks on a client: one that cannot keep up
+// is dropped so it cannot stall the upstream stream or the other clients.
+type eventHub struct {
+	upstream string
+	client   *http.Client
+
+	// ctx bounds the upstream subscription. It is set by Server.Start; the subscription
+	// itself is opened when the first client connects and then kept for replay.
+	ctx     context.Context
+	runOnce sync.Once
+	// logln reports dropped clients; it may be nil.
+	logln func(msg string)
+
+	mu      sync.Mutex
+	ring    *eventRing
+	nextID  uint64
+	clients map[*eventClient]struct{}
+}
+
+// eventClient is one connected SSE client.
+type eventClient struct {
+	filter eventFilter
+	events chan globalEvent
+	// dropped is closed when the client is disconnected for falling behind.
+	dropped chan struct{}
+	// abort unblocks a write that is stuck on the client's connection.
+	abort func()
+}
+
+func newEventHub(upstream string, size int, startedAt time.Time) *eventHub {
+	return &eventHub{
+		upstream: upstream,
+		client:   &http.Client{},
+		ring:     newEventRing(size),
+		// Seeding IDs from the start time keeps them increasing across agent restarts, so a
+		// client holding an ID from an earlier process is told to resync rather than getting
+		// an unrelated replay.
+		nextID:  uint64(startedAt.UnixMilli()) * 1000,
+		clients: make(map[*eventClient]struct{}),
+	}
+}
+
+func (h *eventHub) ensureRunning() {
+	h.runOnce.Do(func() {
+		if h.ctx != nil {
+			go h.run(h.ctx)
+		}
+	})
+}
+
+// run subscribes to the upstream until ctx is canceled, reconnecting when OpenCode restarts.
+func (h *eventHub) run(ctx context.Context) {
+	backoff := 250 * time.Millisecond
+	for ctx.Err() == nil {
+		start := time.Now()
+		_ = h.connect(ctx)
+		if time.Since(start) > 10*time.Second {
+			backoff = 250 * time.Millisecond
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (h *eventHub) connect(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.upstream+globalEventPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream %s returned %s", globalEventPath, resp.Status)
+	}
+	return readEvents(resp.Body, h.publish)
+}
+
+// readEvents parses an SSE stream and calls fn with the data of every event.
+func readEvents(body io.Reader, fn func(data []byte)) error {
+	reader := bufio.NewReader(body)
+	var data []byte
+	hasData := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			if hasData {
+				fn(data)
+			}
+			data, hasData = nil, false
+		case bytes.HasPrefix(line, []byte("data:")):
+			value := bytes.TrimPrefix(line[len("data:"):], []byte(" "))
+			if hasData {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+			hasData = true
+		}
+		// Comments, id, event and retry fields are ignored; the gateway assigns its own IDs.
+	}
+}
+
+func (h *eventHub) publish(data []byte) {
+	var envelope struct {
+		Directory string `json:"directory"`
+		Payload   struct {
+			Type       string `json:"type"`
+			Properties struct {
+				Part struct {
+					ID string `json:"id"`
+				} `json:"part"`
+				Delta *string `json:"delta"`
+			} `json:"properties"`
+		} `json:"payload"`
+	}
+	_ = json.Unmarshal(data, &envelope)
+	if envelope.Payload.Type == "server.connected" {
+		// Per-subscription handshake; every client gets its own greeting instead.
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := globalEvent{
+		id:        h.nextID,
+		data:      data,
+		directory: envelope.Directory,
+		typ:       envelope.Payload.Type,
+	}
+	if e.typ == partUpdatedType {
+		e.partID = envelope.Payload.Properties.Part.ID
+		if d := envelope.Payload.Properties.Delta; d != nil {
+			e.delta, e.hasDelta = *d, true
+		}
+	}
+	h.nextID++
+	h.ring.add(e)
+	for c := range h.clients {
+		if !c.filter.allows(e) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+			delete(h.clients, c)
+			close(c.dropped)
+			c.abort()
+			if h.logln != nil {
+				h.logln("dropped a slow event stream client")
+			}
+		}
+	}
+}
+
+// addClient registers a client. If replay is set, it also returns the buffered events after
+// lastID that pass filter, and whether that replay is complete. Registration and replay happen
+// under one lock so no event falls between the replay and the live stream.
+func (h *eventHub) addClient(filter eventFilter, lastID uint64, replay bool, abort func()) (*eventClient, []globalEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := &eventClient{
+		filter:  filter,
+		events:  make(chan globalEvent, clientQueueSize),
+		dropped: make(chan struct{}),
+		abort:   abort,
+	}
+	h.clients[c] = struct{}{}
+	if !replay {
+		return c, nil, true
+	}
+	buffered, ok := h.ring.after(lastID, h.nextID)
+	events := buffered[:0]
+	for _, e := range buffered {
+		if filter.allows(e) {
+			events = append(events, e)
+		}
+	}
+	return c, events, ok
+}
+
+func (h *eventHub) removeClient(c *eventClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+}
+
+// clientCount returns how many clients are currently streaming global events.
+func (h *eventHub) clientCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// serve streams global events to one client, replaying what it missed since Last-Event-ID.
+func (h *eventHub) serve(w http.ResponseWriter, r *http.Request) {
+	window, err := parseCoalesceWindow(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error(), 0)
+		return
+	}
+	h.ensureRunning()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	replay := err == nil
+	c, events, complete := h.addClient(parseEventFilter(r), lastID, replay, func() {
+		_ = rc.SetWriteDeadline(time.Now())
+	})
+	defer h.removeClient(c)
+
+	coalescer := newPartCoalescer(window)
+	write := func(events []globalEvent) error {
+		for _, e := range events {
+			if err := writeEvent(w, strconv.FormatUint(e.id, 10), e.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := writeEvent(w, "", connectedEvent); err != nil {
+		return
+	}
+	if !complete {
+		if err := writeEvent(w, "", resyncEvent); err != nil {
+			return
+		}
+	}
+	for _, e := range events {
+		if err := write(coalescer.add(e)); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-c.dropped:
+			return
+		default:
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.dropped:
+			return
+		case <-coalescer.expired():
+			if err := write(coalescer.flush()); err != nil {
+				return
+			}
+		case e := <-c.events:
+			if err := write(coalescer.add(e)); err != nil {
+				return
+			}
+		}
+		// Write whatever else is queued before flushing.
+		for pending := len(c.events); pending > 0; pending-- {
+			if err := write(coalescer.add(<-c.events)); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w io.Writer, id string, data []byte) error {
+	var buf bytes.Buffer
+	if id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
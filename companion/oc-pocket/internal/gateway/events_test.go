@@ -0,0 +1,319 @@
+package gateway_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+type sseEvent struct {
+	id   string
+	data string
+}
+
+func readSSEEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if e.data != "" {
+				return e
+			}
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func globalEvent(typ string, n int) string {
+	return fmt.Sprintf(`{"directory":"/work","payload":{"type":%q,"properties":{"n":%d}}}`, typ, n)
+}
+
+// startEventGateway starts a gateway in front of an upstream whose /global/event stream
+// sends whatever is written to the returned channel.
+func startEventGateway(t *testing.T, bufferSize int) (*gateway.Server, chan<- string, *atomic.Int32) {
+	t.Helper()
+
+	send := make(chan string)
+	subscriptions := &atomic.Int32{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/global/event" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		subscriptions.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprint(w, "data: "+globalEvent("server.connected", 0)+"\n\n")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case data := <-send:
+				_, _ = fmt.Fprint(w, "data: "+data+"\n\n")
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr:      "127.0.0.1:0",
+		Upstream:        upstream.URL,
+		Token:           "tok",
+		EventBufferSize: bufferSize,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+	return gw, send, subscriptions
+}
+
+func subscribe(t *testing.T, gw *gateway.Server, lastEventID string) (*bufio.Reader, func()) {
+	t.Helper()
+	return subscribePath(t, gw, "/global/event", lastEventID)
+}
+
+func subscribePath(t *testing.T, gw *gateway.Server, path string, lastEventID string) (*bufio.Reader, func()) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", gw.BaseURL()+path, nil)
+	req.Header.Set("Authorization", "Bearer tok")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("subscribe status: got=%d", resp.StatusCode)
+	}
+	reader := bufio.NewReader(resp.Body)
+	if e := readSSEEvent(t, reader); !strings.Contains(e.data, "server.connected") {
+		t.Fatalf("first event should be server.connected: %+v", e)
+	}
+	return reader, func() { _ = resp.Body.Close() }
+}
+
+func TestGateway_GlobalEvents_ReplayAfterLastEventID(t *testing.T) {
+	t.Parallel()
+
+	gw, send, subscriptions := startEventGateway(t, 3)
+
+	first, closeFirst := subscribe(t, gw, "")
+	var ids []uint64
+	for i := 1; i <= 5; i++ {
+		send <- globalEvent("session.updated", i)
+		e := readSSEEvent(t, first)
+		if !strings.Contains(e.data, fmt.Sprintf(`"n":%d`, i)) {
+			t.Fatalf("live event %d: got=%+v", i, e)
+		}
+		id, err := strconv.ParseUint(e.id, 10, 64)
+		if err != nil {
+			t.Fatalf("event id %q: %v", e.id, err)
+		}
+		if len(ids) > 0 && id != ids[len(ids)-1]+1 {
+			t.Fatalf("ids must be monotonic: %v then %d", ids, id)
+		}
+		ids = append(ids, id)
+	}
+	closeFirst()
+
+	// Reconnect having seen event 3: events 4 and 5 are replayed, then live events follow.
+	second, closeSecond := subscribe(t, gw, strconv.FormatUint(ids[2], 10))
+	defer closeSecond()
+	for _, want := range []int{4, 5} {
+		if e := readSSEEvent(t, second); e.id != strconv.FormatUint(ids[want-1], 10) {
+			t.Fatalf("replayed event %d: got=%+v", want, e)
+		}
+	}
+	send <- globalEvent("session.updated", 6)
+	if e := readSSEEvent(t, second); !strings.Contains(e.data, `"n":6`) || e.id != strconv.FormatUint(ids[4]+1, 10) {
+		t.Fatalf("live event after replay: got=%+v", e)
+	}
+
+	// Event 1 has fallen out of the 3-event buffer: the client is told to resync and gets
+	// everything that is still buffered.
+	third, closeThird := subscribe(t, gw, strconv.FormatUint(ids[0], 10))
+	defer closeThird()
+	if e := readSSEEvent(t, third); !strings.Contains(e.data, "oc-pocket.resync") {
+		t.Fatalf("expected resync event: got=%+v", e)
+	}
+	for _, want := range []int{4, 5, 6} {
+		if e := readSSEEvent(t, third); !strings.Contains(e.data, fmt.Sprintf(`"n":%d`, want)) {
+			t.Fatalf("buffered event %d: got=%+v", want, e)
+		}
+	}
+
+	if n := subscriptions.Load(); n != 1 {
+		t.Fatalf("upstream subscriptions: got=%d want=1", n)
+	}
+}
+
+func TestGateway_GlobalEvents_HeartbeatsOnHubStreams(t *testing.T) {
+	t.Parallel()
+
+	send := make(chan string)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprint(w, "data: "+globalEvent("server.connected", 0)+"\n\n")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case data := <-send:
+				_, _ = fmt.Fprint(w, "data: "+data+"\n\n")
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr:   "127.0.0.1:0",
+		Upstream:     upstream.URL,
+		Token:        "tok",
+		SSEHeartbeat: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	reader, closeStream := subscribe(t, gw, "")
+	defer closeStream()
+
+	heartbeats := 0
+	for heartbeats < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if line == ": heartbeat\n" {
+			heartbeats++
+		}
+	}
+
+	// Events still arrive whole after the stream has been idle.
+	send <- globalEvent("session.updated", 1)
+	if e := readSSEEvent(t, reader); !strings.Contains(e.data, `"n":1`) || e.id == "" {
+		t.Fatalf("event after heartbeats: got=%+v", e)
+	}
+}
+
+func TestGateway_GlobalEvents_FilterByDirectoryAndType(t *testing.T) {
+	t.Parallel()
+
+	gw, send, _ := startEventGateway(t, 10)
+
+	filtered, closeFiltered := subscribePath(t, gw, "/global/event?directory=/work&type=session.*,permission.asked", "")
+	defer closeFiltered()
+	all, closeAll := subscribe(t, gw, "")
+	defer closeAll()
+
+	events := []string{
+		`{"directory":"/other","payload":{"type":"session.updated","properties":{"n":1}}}`,
+		`{"directory":"/work","payload":{"type":"message.part.updated","properties":{"n":2}}}`,
+		`{"directory":"/work/","payload":{"type":"session.status","properties":{"n":3}}}`,
+		`{"directory":"/work","payload":{"type":"permission.asked","properties":{"n":4}}}`,
+	}
+	for _, e := range events {
+		send <- e
+	}
+
+	for i := 1; i <= len(events); i++ {
+		if e := readSSEEvent(t, all); !strings.Contains(e.data, fmt.Sprintf(`"n":%d`, i)) {
+			t.Fatalf("unfiltered client event %d: got=%+v", i, e)
+		}
+	}
+	for _, want := range []int{3, 4} {
+		if e := readSSEEvent(t, filtered); !strings.Contains(e.data, fmt.Sprintf(`"n":%d`, want)) {
+			t.Fatalf("filtered client: got=%+v want event %d", e, want)
+		}
+	}
+}
+
+func TestGateway_GlobalEvents_CoalescePartUpdates(t *testing.T) {
+	t.Parallel()
+
+	gw, send, _ := startEventGateway(t, 10)
+
+	coalesced, closeCoalesced := subscribePath(t, gw, "/global/event?coalesce=2s", "")
+	defer closeCoalesced()
+
+	partUpdate := func(partID string, text string, delta string) string {
+		return fmt.Sprintf(`{"directory":"/work","payload":{"type":"message.part.updated","properties":{"part":{"id":%q,"type":"text","text":%q},"delta":%q}}}`, partID, text, delta)
+	}
+	send <- partUpdate("prt_a", "Hel", "Hel")
+	send <- partUpdate("prt_a", "Hello", "lo")
+	send <- partUpdate("prt_a", "Hello world", " world")
+	send <- partUpdate("prt_b", "Other", "Other")
+	// A non-delta event flushes the pending part immediately instead of waiting for the window.
+	send <- `{"directory":"/work","payload":{"type":"permission.asked","properties":{"id":"per_1"}}}`
+
+	type partEvent struct {
+		Payload struct {
+			Type       string `json:"type"`
+			Properties struct {
+				Part struct {
+					ID   string `json:"id"`
+					Text string `json:"text"`
+				} `json:"part"`
+				Delta string `json:"delta"`
+			} `json:"properties"`
+		} `json:"payload"`
+	}
+	decode := func(e sseEvent) partEvent {
+		t.Helper()
+		var p partEvent
+		if err := json.Unmarshal([]byte(e.data), &p); err != nil {
+			t.Fatalf("decode %q: %v", e.data, err)
+		}
+		return p
+	}
+
+	start := time.Now()
+	first := decode(readSSEEvent(t, coalesced))
+	if first.Payload.Properties.Part.ID != "prt_a" || first.Payload.Properties.Part.Text != "Hello world" || first.Payload.Properties.Delta != "Hello world" {
+		t.Fatalf("merged part a: got=%+v", first)
+	}
+	second := decode(readSSEEvent(t, coalesced))
+	if second.Payload.Properties.Part.ID != "prt_b" || second.Payload.Properties.Delta != "Other" {
+		t.Fatalf("part b: got=%+v", second)
+	}
+	if third := decode(readSSEEvent(t, coalesced)); third.Payload.Type != "permission.asked" {
+		t.Fatalf("permission event: got=%+v", third)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("events were held for the whole window: %v", time.Since(start))
+	}
+}
@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Clients can limit /global/event to some directories and event types, either with repeated
+// query parameters (?directory=/a&directory=/b&type=session.*) or with the equivalent headers.
+const (
+	directoryParam  = "directory"
+	typeParam       = "type"
+	directoryHeader = "X-OC-Pocket-Directory"
+	typeHeader      = "X-OC-Pocket-Event-Type"
+)
+
+// eventFilter selects the global events forwarded to one client. The zero value forwards
+// everything.
+type eventFilter struct {
+	directories map[string]bool
+	// types are exact event types, or prefixes when they end in `*` (e.g. "session.*").
+	types []string
+}
+
+func parseEventFilter(r *http.Request) eventFilter {
+	var f eventFilter
+
+	query := r.URL.Query()
+	dirs := append(query[directoryParam], r.Header.Values(directoryHeader)...)
+	for _, d := range dirs {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		if f.directories == nil {
+			f.directories = make(map[string]bool)
+		}
+		f.directories[filepath.Clean(d)] = true
+	}
+
+	// Event types never contain commas, so comma-separated lists are accepted too.
+	for _, v := range append(query[typeParam], r.Header.Values(typeHeader)...) {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				f.types = append(f.types, t)
+			}
+		}
+	}
+	return f
+}
+
+// allows reports whether e should be forwarded. Events without a directory are not tied to a
+// project and pass the directory filter.
+func (f eventFilter) allows(e globalEvent) bool {
+	if f.directories != nil && e.directory != "" && !f.directories[filepath.Clean(e.directory)] {
+		return false
+	}
+	if len(f.types) == 0 {
+		return true
+	}
+	for _, t := range f.types {
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			if strings.HasPrefix(e.typ, prefix) {
+				return true
+			}
+		} else if e.typ == t {
+			return true
+		}
+	}
+	return false
+}
@@ -3,25 +3,145 @@ package gateway
 import (
 	"context"
 	"crypto/subtle"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strings"
 	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/metrics"
 )
 
 type Options struct {
 	ListenAddr string
 	Upstream   string
-	Token      string
+	// Auth resolves bearer tokens to devices. If nil, Token is used as a single shared token.
+	Auth  Authenticator
+	Token string
+	// Lockout throttles failed authentication attempts. If nil, DefaultLockoutPolicy is used.
+	Lockout *Lockout
+	// TLSConfig makes the gateway serve HTTPS instead of plain HTTP.
+	TLSConfig *tls.Config
+	// TrustForwardedFor takes the client IP of requests from loopback from X-Forwarded-For, for
+	// lockouts and the access log. Set it only when Tailscale Serve proxies the gateway.
+	TrustForwardedFor bool
+
+	// Version and HostName are reported by /__oc-pocket/health and /__oc-pocket/whoami.
+	Version  string
+	HostName string
+	// StartedAt is when the agent started. Defaults to when the gateway was created.
+	StartedAt time.Time
+	// UpstreamReady reports whether OpenCode is accepting requests. Defaults to a TCP dial.
+	UpstreamReady func() bool
+	// UpstreamStatus reports what the supervisor knows about OpenCode. It is used to explain
+	// failed requests; if nil, the state is unknown.
+	UpstreamStatus func() UpstreamStatus
+	// AwaitUpstream blocks until OpenCode is ready or ctx is done. If nil, UpstreamReady is
+	// polled instead.
+	AwaitUpstream func(ctx context.Context) error
+	// HoldTimeout is how long requests are held while OpenCode is starting or restarting.
+	// Zero uses DefaultHoldTimeout; a negative value fails them immediately.
+	HoldTimeout time.Duration
+	// Admin serves the agent's admin API under /__oc-pocket/admin/ to devices with the admin
+	// scope. Paths are passed on with the prefix stripped.
+	Admin http.Handler
+	// Log receives the gateway's diagnostics, such as bans, dropped event streams and HTTP
+	// server errors. If nil, they are written to stderr.
+	Log io.Writer
+	// AccessLog receives a JSON line (AccessEntry) per request. If nil, requests are not
+	// logged.
+	AccessLog io.Writer
+	// Audit is called after every state-changing request (prompts, commands, aborts, reverts,
+	// forks, permission replies) has been answered. If nil, nothing is audited.
+	Audit func(AuditEvent)
+	// Metrics, if set, gets the gateway's request, stream, authentication and upstream
+	// metrics registered on it.
+	Metrics *metrics.Registry
+	// SSEHeartbeat is how often idle text/event-stream responses get a heartbeat comment.
+	// Zero uses DefaultSSEHeartbeat; a negative value disables heartbeats.
+	SSEHeartbeat time.Duration
+	// EventBufferSize is how many /global/event events are kept for Last-Event-ID replay.
+	// Zero uses DefaultEventBufferSize; a negative value proxies each stream to OpenCode as is.
+	EventBufferSize int
+}
+
+// Principal identifies the device that authenticated a request.
+type Principal struct {
+	Device string
+	Scope  config.Scope
+}
+
+// Authenticator resolves a bearer token to the device it was issued to.
+// It returns an error for unknown or revoked tokens.
+type Authenticator interface {
+	Authenticate(token string) (Principal, error)
+}
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenRevoked is returned for tokens of revoked devices.
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// UpstreamState is the supervisor's view of the OpenCode process.
+type UpstreamState string
+
+const (
+	UpstreamUnknown  UpstreamState = ""
+	UpstreamStarting UpstreamState = "starting"
+	UpstreamRunning  UpstreamState = "running"
+	// UpstreamCrashed means OpenCode exited and the supervisor is backing off before
+	// restarting it.
+	UpstreamCrashed UpstreamState = "crashed"
+	// UpstreamStopped means OpenCode kept crashing and the supervisor gave up until someone
+	// restarts it.
+	UpstreamStopped UpstreamState = "stopped"
+)
+
+type UpstreamStatus struct {
+	State UpstreamState
+	// RetryAfter estimates how long until OpenCode accepts requests again.
+	RetryAfter time.Duration
+	LastError  string
+}
+
+// StaticToken authenticates a single shared token with admin scope.
+type StaticToken string
+
+func (t StaticToken) Authenticate(token string) (Principal, error) {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(t)) != 1 {
+		return Principal{}, ErrInvalidToken
+	}
+	return Principal{Scope: config.ScopeAdmin}, nil
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the device that authenticated the request, if any.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
 }
 
 type Server struct {
-	opts   Options
-	server *http.Server
-	ln     net.Listener
+	opts           Options
+	server         *http.Server
+	ln             net.Listener
+	lockout        *Lockout
+	startedAt      time.Time
+	upstreamReady  func() bool
+	upstreamStatus func() UpstreamStatus
+	holdTimeout    time.Duration
+	events         *eventHub
+	metrics        *gatewayMetrics
 }
 
 func New(opts Options) (*Server, error) {
@@ -31,8 +151,17 @@ func New(opts Options) (*Server, error) {
 	if strings.TrimSpace(opts.Upstream) == "" {
 		return nil, errors.New("Upstream is required")
 	}
-	if strings.TrimSpace(opts.Token) == "" {
-		return nil, errors.New("Token is required")
+	auth := opts.Auth
+	if auth == nil {
+		if strings.TrimSpace(opts.Token) == "" {
+			return nil, errors.New("Auth or Token is required")
+		}
+		auth = StaticToken(opts.Token)
+	}
+
+	lockout := opts.Lockout
+	if lockout == nil {
+		lockout = NewLockout(DefaultLockoutPolicy())
 	}
 
 	upstreamURL, err := url.Parse(opts.Upstream)
@@ -44,6 +173,9 @@ func New(opts Options) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	if opts.TLSConfig != nil {
+		ln = tls.NewListener(ln, opts.TLSConfig)
+	}
 
 	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
 	proxy.FlushInterval = 25 * time.Millisecond
@@ -55,32 +187,132 @@ func New(opts Options) (*Server, error) {
 		r.Header.Del("Authorization")
 	}
 
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
-		http.Error(w, "bad gateway", http.StatusBadGateway)
+	s := &Server{
+		opts:          opts,
+		ln:            ln,
+		lockout:       lockout,
+		startedAt:     opts.StartedAt,
+		upstreamReady: opts.UpstreamReady,
+	}
+	if s.startedAt.IsZero() {
+		s.startedAt = time.Now()
+	}
+	if s.upstreamReady == nil {
+		s.upstreamReady = func() bool { return dialReady(upstreamURL.Host) }
+	}
+	s.holdTimeout = opts.HoldTimeout
+	if s.holdTimeout == 0 {
+		s.holdTimeout = DefaultHoldTimeout
+	}
+	proxy.Transport = &retryTransport{base: http.DefaultTransport, s: s}
+	s.upstreamStatus = opts.UpstreamStatus
+	if s.upstreamStatus == nil {
+		s.upstreamStatus = func() UpstreamStatus { return UpstreamStatus{} }
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		s.writeUpstreamError(w, err)
+	}
+
+	switch {
+	case opts.EventBufferSize == 0:
+		s.events = newEventHub(opts.Upstream, DefaultEventBufferSize, s.startedAt)
+	case opts.EventBufferSize > 0:
+		s.events = newEventHub(opts.Upstream, opts.EventBufferSize, s.startedAt)
 	}
+	if s.events != nil {
+		s.events.logln = s.logln
+	}
+
+	heartbeat := opts.SSEHeartbeat
+	if heartbeat == 0 {
+		heartbeat = DefaultSSEHeartbeat
+	}
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == healthPath {
+			s.serveHealth(w, r)
+			return
+		}
+
+		ip := remoteIP(r, opts.TrustForwardedFor)
+		if banned, remaining := lockout.Banned(ip); banned {
+			s.metrics.authFailure("locked_out")
+			writeLockedOut(w, remaining)
+			return
+		}
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if authHeader == token || subtle.ConstantTimeCompare([]byte(token), []byte(opts.Token)) != 1 {
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			w.WriteHeader(http.StatusUnauthorized)
-			_, _ = w.Write([]byte("unauthorized"))
+		principal, err := Principal{}, ErrInvalidToken
+		if authHeader != token && token != "" {
+			principal, err = auth.Authenticate(token)
+		}
+		if err != nil {
+			if errors.Is(err, ErrTokenRevoked) {
+				s.metrics.authFailure("revoked")
+			} else {
+				s.metrics.authFailure("invalid")
+			}
+			delay, banned := lockout.Failure(ip)
+			if banned {
+				s.logln("banned " + ip + " after repeated authentication failures")
+			}
+			// Delay the response so guessing tokens gets exponentially slower.
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			writeUnauthorized(w, err)
+			return
+		}
+		lockout.Success(ip)
+		setAccessDevice(r.Context(), principal.Device)
+		if strings.HasPrefix(r.URL.Path, reservedPrefix) {
+			s.serveReserved(w, r, principal)
+			return
+		}
+		if required, action := requiredScope(r.Method, r.URL.EscapedPath()); !principal.Scope.Allows(required) {
+			writeForbidden(w, fmt.Sprintf("forbidden: %s requires the %q scope; this device's token only has the %q scope", action, required, principal.Scope))
 			return
 		}
-		proxy.ServeHTTP(w, r)
+		next := s.holdUntilReady(proxy)
+		if s.events != nil && r.Method == http.MethodGet && r.URL.Path == globalEventPath {
+			next = http.HandlerFunc(s.events.serve)
+		}
+		if s.opts.Audit != nil {
+			if action, session, ok := auditAction(r.Method, r.URL.EscapedPath()); ok {
+				next = s.audited(next, principal.Device, action, session)
+			}
+		}
+		ctx := context.WithValue(r.Context(), principalKey{}, principal)
+		if heartbeat <= 0 {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		sw := newSSEWriter(w, heartbeat, cancel)
+		defer sw.Close()
+		next.ServeHTTP(sw, r.WithContext(ctx))
 	})
 
-	srv := &http.Server{
+	if opts.Metrics != nil {
+		s.metrics = newGatewayMetrics(opts.Metrics, s)
+		handler = s.metrics.wrap(handler)
+	}
+	if opts.AccessLog != nil {
+		handler = newAccessLog(opts.AccessLog, opts.TrustForwardedFor).wrap(handler)
+	}
+
+	s.server = &http.Server{
 		Handler:           handler,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
-
-	return &Server{
-		opts:   opts,
-		server: srv,
-		ln:     ln,
-	}, nil
+	if opts.Log != nil {
+		s.server.ErrorLog = log.New(opts.Log, "", 0)
+	}
+	return s, nil
 }
 
 func (s *Server) Start(ctx context.Context) error {
@@ -88,6 +320,10 @@ func (s *Server) Start(ctx context.Context) error {
 		return errors.New("server not initialized")
 	}
 
+	if s.events != nil {
+		s.events.ctx = ctx
+	}
+
 	shutdownDone := make(chan struct{})
 	go func() {
 		defer close(shutdownDone)
@@ -118,9 +354,46 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Lockout returns the failed-authentication tracker used by the server.
+func (s *Server) Lockout() *Lockout {
+	if s == nil {
+		return nil
+	}
+	return s.lockout
+}
+
+// EventClients returns how many clients are streaming /global/event from the shared
+// subscription.
+func (s *Server) EventClients() int {
+	if s == nil || s.events == nil {
+		return 0
+	}
+	return s.events.clientCount()
+}
+
+// logln writes a diagnostic line to Options.Log, or to stderr.
+func (s *Server) logln(msg string) {
+	if s.opts.Log != nil {
+		fmt.Fprintln(s.opts.Log, msg)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "oc-pocket: "+msg)
+}
+
+// Addr returns the address the gateway is listening on.
+func (s *Server) Addr() string {
+	if s == nil || s.ln == nil {
+		return ""
+	}
+	return s.ln.Addr().String()
+}
+
 func (s *Server) BaseURL() string {
 	if s == nil || s.ln == nil {
 		return ""
 	}
+	if s.opts.TLSConfig != nil {
+		return "https://" + s.ln.Addr().String()
+	}
 	return "http://" + s.ln.Addr().String()
 }
@@ -3,15 +3,21 @@ package gateway_test
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/tlsutil"
 )
 
 func TestGateway_AuthEnforced_AndAuthorizationNotForwarded(t *testing.T) {
@@ -72,6 +78,401 @@ func TestGateway_AuthEnforced_AndAuthorizationNotForwarded(t *testing.T) {
 	}
 }
 
+type mapAuth map[string]gateway.Principal
+
+func (m mapAuth) Authenticate(token string) (gateway.Principal, error) {
+	if p, ok := m[token]; ok {
+		return p, nil
+	}
+	return gateway.Principal{}, gateway.ErrInvalidToken
+}
+
+func TestGateway_Authenticator_PerDeviceTokens(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   upstream.URL,
+		Auth: mapAuth{
+			"tok_phone": {Device: "iphone", Scope: config.ScopeChat},
+			"tok_pad":   {Device: "ipad", Scope: config.ScopeRead},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	for token, want := range map[string]int{
+		"tok_phone": http.StatusOK,
+		"tok_pad":   http.StatusOK,
+		"tok_other": http.StatusUnauthorized,
+	} {
+		req, _ := http.NewRequest("GET", gw.BaseURL()+"/hello", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do(%s) error: %v", token, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("status (%s): got=%d want=%d", token, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestGateway_ScopesEnforcedByMethodAndPath(t *testing.T) {
+	t.Parallel()
+
+	var upstreamHits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits++
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   upstream.URL,
+		Auth: mapAuth{
+			"tok_read":  {Device: "lead", Scope: config.ScopeRead},
+			"tok_chat":  {Device: "iphone", Scope: config.ScopeChat},
+			"tok_admin": {Device: "mac", Scope: config.ScopeAdmin},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	cases := []struct {
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"tok_read", "GET", "/session/ses_1/message", http.StatusOK},
+		{"tok_read", "POST", "/session/ses_1/message", http.StatusForbidden},
+		{"tok_read", "POST", "/session/ses_1/abort", http.StatusForbidden},
+		{"tok_read", "POST", "/permission/per_1/reply", http.StatusForbidden},
+		{"tok_read", "DELETE", "/session/ses_1", http.StatusForbidden},
+		{"tok_chat", "POST", "/session/ses_1/message", http.StatusOK},
+		{"tok_chat", "POST", "/permission/per_1/reply", http.StatusOK},
+		{"tok_chat", "PATCH", "/config", http.StatusForbidden},
+		{"tok_chat", "GET", "//pty/pty_1/connect", http.StatusForbidden},
+		{"tok_chat", "POST", "/session/a%2Fb/shell", http.StatusForbidden},
+		{"tok_chat", "POST", "/session/ses_1/sh%65ll", http.StatusForbidden},
+		{"tok_chat", "GET", "/session/%2e%2e/pty/pty_1/connect", http.StatusForbidden},
+		{"tok_admin", "PATCH", "/config", http.StatusOK},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, gw.BaseURL()+tc.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s (%s) error: %v", tc.method, tc.path, tc.token, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatalf("%s %s (%s): got=%d want=%d body=%q", tc.method, tc.path, tc.token, resp.StatusCode, tc.want, string(body))
+		}
+		if resp.StatusCode == http.StatusForbidden && !strings.Contains(string(body), "scope") {
+			t.Fatalf("403 body should explain the missing scope: %q", string(body))
+		}
+	}
+	if upstreamHits != 4 {
+		t.Fatalf("upstream hits: got=%d want=%d", upstreamHits, 4)
+	}
+}
+
+func TestGateway_RepeatedAuthFailures_BanRemoteIP(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	lockout := gateway.NewLockout(gateway.LockoutPolicy{
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    4 * time.Millisecond,
+		MaxFailures: 3,
+		BanDuration: time.Hour,
+		Window:      time.Hour,
+	})
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   upstream.URL,
+		Token:      "tok",
+		Lockout:    lockout,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	get := func(token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", gw.BaseURL()+"/hello", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do() error: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := get("wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got=%d want=%d", i, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// Banned: even the right token is rejected until the ban is cleared.
+	resp := get("tok")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("banned status: got=%d want=%d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+
+	offenders := lockout.Snapshot()
+	if len(offenders) != 1 || offenders[0].IP != "127.0.0.1" || offenders[0].BannedUntilMs == 0 {
+		t.Fatalf("offenders: got=%+v", offenders)
+	}
+
+	if !lockout.Clear("127.0.0.1") {
+		t.Fatalf("Clear() should report the banned IP")
+	}
+	if resp := get("tok"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status after clear: got=%d want=%d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestGateway_TLS_ServesPinnedCertificate(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	bundle, err := tlsutil.Ensure(t.TempDir(), []string{"127.0.0.1"}, nil, time.Now())
+	if err != nil {
+		t.Fatalf("Ensure() error: %v", err)
+	}
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   upstream.URL,
+		Token:      "tok",
+		TLSConfig:  bundle.ServerConfig(),
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+	if !strings.HasPrefix(gw.BaseURL(), "https://") {
+		t.Fatalf("BaseURL: got=%q", gw.BaseURL())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	// Pin the CA fingerprint the way the app does instead of trusting a root store.
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				for _, raw := range rawCerts {
+					if tlsutil.Fingerprint(raw) == bundle.CAFingerprint {
+						return nil
+					}
+				}
+				return fmt.Errorf("pinned certificate not presented")
+			},
+		}},
+	}
+	req, _ := http.NewRequest("GET", gw.BaseURL()+"/hello", nil)
+	req.Header.Set("Authorization", "Bearer tok")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do() error: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: got=%d want=%d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestGateway_HealthIsPublic_WhoAmIRequiresAuth(t *testing.T) {
+	t.Parallel()
+
+	var upstreamReady atomic.Bool
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr:    "127.0.0.1:0",
+		Upstream:      upstream.URL,
+		Auth:          mapAuth{"tok_read": {Device: "lead", Scope: config.ScopeRead}},
+		Version:       "1.2.3",
+		HostName:      "my-mac",
+		UpstreamReady: upstreamReady.Load,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	getJSON := func(path string, token string, out any) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", gw.BaseURL()+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s error: %v", path, err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if out != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatalf("decode %s: %v", path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var health gateway.Health
+	if code := getJSON("/__oc-pocket/health", "", &health); code != http.StatusOK {
+		t.Fatalf("health status: got=%d want=%d", code, http.StatusOK)
+	}
+	if health.Version != "1.2.3" || health.Upstream.Ready || health.Status != "upstream_unavailable" {
+		t.Fatalf("health: got=%+v", health)
+	}
+	upstreamReady.Store(true)
+	if getJSON("/__oc-pocket/health", "", &health); !health.Upstream.Ready || health.Status != "ok" {
+		t.Fatalf("health (ready): got=%+v", health)
+	}
+
+	if code := getJSON("/__oc-pocket/whoami", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("whoami (no auth): got=%d want=%d", code, http.StatusUnauthorized)
+	}
+	var who gateway.WhoAmI
+	if code := getJSON("/__oc-pocket/whoami", "tok_read", &who); code != http.StatusOK {
+		t.Fatalf("whoami status: got=%d want=%d", code, http.StatusOK)
+	}
+	if who.Host != "my-mac" || who.Device != "lead" || who.Scope != "read" || len(who.Capabilities) == 0 {
+		t.Fatalf("whoami: got=%+v", who)
+	}
+
+	if code := getJSON("/__oc-pocket/unknown", "tok_read", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown reserved path: got=%d want=%d", code, http.StatusNotFound)
+	}
+	if n := upstreamHits.Load(); n != 0 {
+		t.Fatalf("reserved paths must not be proxied (upstream hits: %d)", n)
+	}
+}
+
+func TestGateway_AdminAPI_RequiresAdminScope(t *testing.T) {
+	t.Parallel()
+
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	var sawAdminPath atomic.Value
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawAdminPath.Store(r.Method + " " + r.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   upstream.URL,
+		Auth: mapAuth{
+			"tok_chat":  {Device: "ipad", Scope: config.ScopeChat},
+			"tok_admin": {Device: "phone", Scope: config.ScopeAdmin},
+		},
+		Admin: admin,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	post := func(path string, token string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", gw.BaseURL()+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s error: %v", path, err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("/__oc-pocket/admin/opencode/restart", "tok_chat"); code != http.StatusForbidden {
+		t.Fatalf("admin API (chat scope): got=%d want=%d", code, http.StatusForbidden)
+	}
+	if sawAdminPath.Load() != nil {
+		t.Fatalf("admin handler must not run for a chat-scoped token")
+	}
+	if code := post("/__oc-pocket/admin/opencode/restart", "tok_admin"); code != http.StatusAccepted {
+		t.Fatalf("admin API (admin scope): got=%d want=%d", code, http.StatusAccepted)
+	}
+	if got := sawAdminPath.Load(); got != "POST /opencode/restart" {
+		t.Fatalf("admin handler path: got=%v want=%q", got, "POST /opencode/restart")
+	}
+	if n := upstreamHits.Load(); n != 0 {
+		t.Fatalf("admin API must not be proxied (upstream hits: %d)", n)
+	}
+}
+
 func TestGateway_SSE_IsStreamed(t *testing.T) {
 	t.Parallel()
 
@@ -131,3 +532,145 @@ func TestGateway_SSE_IsStreamed(t *testing.T) {
 		t.Fatalf("first SSE chunk arrived too late: %v", time.Since(start))
 	}
 }
+
+func TestGateway_SSE_HeartbeatsOnlyBetweenEvents(t *testing.T) {
+	t.Parallel()
+
+	upstreamDone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+
+		_, _ = fmt.Fprint(w, "data: first\n\n")
+		flusher.Flush()
+		time.Sleep(300 * time.Millisecond)
+		// A partial event must not be interrupted by a heartbeat.
+		_, _ = fmt.Fprint(w, "data: sec")
+		flusher.Flush()
+		time.Sleep(300 * time.Millisecond)
+		_, _ = fmt.Fprint(w, "ond\n\n")
+		flusher.Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(upstream.Close)
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr:   "127.0.0.1:0",
+		Upstream:     upstream.URL,
+		Token:        "tok",
+		SSEHeartbeat: 50 * time.Millisecond,
+		// Proxy the stream as is; heartbeats on hub-served streams are covered in events_test.go.
+		EventBufferSize: -1,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	req, _ := http.NewRequest("GET", gw.BaseURL()+"/global/event", nil)
+	req.Header.Set("Authorization", "Bearer tok")
+	resp, err := (&http.Client{Timeout: 3 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatalf("Do() error: %v", err)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v (lines so far: %q)", err, lines)
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "data: sec") {
+			break
+		}
+	}
+	if got := lines[len(lines)-1]; got != "data: second\n" {
+		t.Fatalf("event was split by a heartbeat: %q", lines)
+	}
+	heartbeats := 0
+	for _, l := range lines {
+		if l == ": heartbeat\n" {
+			heartbeats++
+		}
+	}
+	if heartbeats == 0 {
+		t.Fatalf("expected heartbeats while the stream was idle; got %q", lines)
+	}
+
+	// Closing the client side must tear down the upstream stream.
+	_ = resp.Body.Close()
+	select {
+	case <-upstreamDone:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("upstream stream was not closed after the client went away")
+	}
+}
+
+func TestGateway_Lockout_TrustsForwardedForOnlyBehindServe(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+
+	cases := []struct {
+		name    string
+		trust   bool
+		forward []string
+		want    string
+	}{
+		{"no serve: rotating header is ignored", false, []string{"100.64.0.1", "100.64.0.2", "100.64.0.3"}, "127.0.0.1"},
+		{"serve: tailnet client", true, []string{"100.64.0.9", "100.64.0.9", "100.64.0.9"}, "100.64.0.9"},
+		{"serve: loopback entry counts as the peer", true, []string{"::1", "127.0.0.2", "::1"}, "127.0.0.1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			lockout := gateway.NewLockout(gateway.LockoutPolicy{
+				BaseDelay:   time.Millisecond,
+				MaxDelay:    time.Millisecond,
+				MaxFailures: len(tc.forward),
+				BanDuration: time.Hour,
+				Window:      time.Hour,
+			})
+			gw, err := gateway.New(gateway.Options{
+				ListenAddr:        "127.0.0.1:0",
+				Upstream:          upstream.URL,
+				Token:             "tok",
+				Lockout:           lockout,
+				TrustForwardedFor: tc.trust,
+			})
+			if err != nil {
+				t.Fatalf("New() error: %v", err)
+			}
+			t.Cleanup(func() { _ = gw.Close() })
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			go func() { _ = gw.Start(ctx) }()
+
+			client := &http.Client{Timeout: 2 * time.Second}
+			for _, fwd := range tc.forward {
+				req, _ := http.NewRequest("GET", gw.BaseURL()+"/hello", nil)
+				req.Header.Set("Authorization", "Bearer wrong")
+				req.Header.Set("X-Forwarded-For", "203.0.113.7, "+fwd)
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("Do() error: %v", err)
+				}
+				_ = resp.Body.Close()
+			}
+
+			offenders := lockout.Snapshot()
+			if len(offenders) != 1 || offenders[0].IP != tc.want || offenders[0].BannedUntilMs == 0 {
+				t.Fatalf("offenders: got=%+v want %s banned", offenders, tc.want)
+			}
+		})
+	}
+}
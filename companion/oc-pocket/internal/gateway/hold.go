@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// DefaultHoldTimeout is how long a request waits for OpenCode to come back before the gateway
+// gives up and returns upstream_starting or upstream_crashed.
+const DefaultHoldTimeout = 20 * time.Second
+
+const (
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = time.Second
+)
+
+type holdDeadlineKey struct{}
+
+// holdUntilReady holds requests while the supervisor reports OpenCode as starting or crashed,
+// up to the hold timeout, instead of failing them immediately. Requests are forwarded as
+// soon as OpenCode is ready.
+func (s *Server) holdUntilReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.holdTimeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		deadline := time.Now().Add(s.holdTimeout)
+		ctx := context.WithValue(r.Context(), holdDeadlineKey{}, deadline)
+
+		if st := s.upstreamStatus().State; st == UpstreamStarting || st == UpstreamCrashed {
+			if err := s.awaitUpstream(ctx, deadline); err != nil {
+				if r.Context().Err() != nil {
+					return
+				}
+				s.writeUpstreamError(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// awaitUpstream waits until OpenCode is ready or deadline passes.
+func (s *Server) awaitUpstream(ctx context.Context, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	if s.opts.AwaitUpstream != nil {
+		return s.opts.AwaitUpstream(ctx)
+	}
+	// Without a supervisor to tell us, poll.
+	for !s.upstreamReady() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(minRetryDelay):
+		}
+	}
+	return nil
+}
+
+// retryTransport retries idempotent requests that could not connect to OpenCode, e.g. because
+// it crashed a moment ago and the supervisor has not noticed yet. Retries stop at the
+// request's hold deadline.
+type retryTransport struct {
+	base http.RoundTripper
+	s    *Server
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	deadline, hold := r.Context().Value(holdDeadlineKey{}).(time.Time)
+	delay := minRetryDelay
+	for {
+		resp, err := t.base.RoundTrip(r)
+		if err == nil || !hold || !isIdempotent(r) || !errors.Is(err, syscall.ECONNREFUSED) {
+			return resp, err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(delay):
+		}
+		if t.s.upstreamStatus().State != UpstreamRunning {
+			if werr := t.s.awaitUpstream(r.Context(), deadline); werr != nil {
+				return nil, err
+			}
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.Body == nil || r.Body == http.NoBody
+	default:
+		return false
+	}
+}
@@ -0,0 +1,125 @@
+package gateway_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+func TestGateway_HoldsRequestsWhileUpstreamRestarts(t *testing.T) {
+	t.Parallel()
+
+	// Reserve an address for the upstream but do not listen yet.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	upstreamAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	var mu sync.Mutex
+	state := gateway.UpstreamRunning
+	ready := make(chan struct{})
+	setState := func(s gateway.UpstreamState) {
+		mu.Lock()
+		defer mu.Unlock()
+		state = s
+		if s == gateway.UpstreamRunning {
+			close(ready)
+		} else {
+			ready = make(chan struct{})
+		}
+	}
+
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr: "127.0.0.1:0",
+		Upstream:   "http://" + upstreamAddr,
+		Token:      "tok",
+		UpstreamStatus: func() gateway.UpstreamStatus {
+			mu.Lock()
+			defer mu.Unlock()
+			return gateway.UpstreamStatus{State: state}
+		},
+		AwaitUpstream: func(ctx context.Context) error {
+			mu.Lock()
+			ch := ready
+			mu.Unlock()
+			select {
+			case <-ch:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+		HoldTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	do := func(method string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, gw.BaseURL()+"/session", nil)
+		req.Header.Set("Authorization", "Bearer tok")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s error: %v", method, err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Non-idempotent requests are never retried.
+	if code := do("POST"); code != http.StatusServiceUnavailable {
+		t.Fatalf("POST with upstream down: got=%d want=%d", code, http.StatusServiceUnavailable)
+	}
+
+	// A GET that hits connection refused is retried until the upstream comes up.
+	var hits atomic.Int32
+	startUpstream := func() {
+		ln, err := net.Listen("tcp", upstreamAddr)
+		if err != nil {
+			t.Errorf("listen upstream: %v", err)
+			return
+		}
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.WriteHeader(http.StatusOK)
+		})}
+		t.Cleanup(func() { _ = srv.Close() })
+		go func() { _ = srv.Serve(ln) }()
+	}
+	time.AfterFunc(300*time.Millisecond, startUpstream)
+	if code := do("GET"); code != http.StatusOK {
+		t.Fatalf("GET retried until upstream is up: got=%d want=%d", code, http.StatusOK)
+	}
+
+	// While the supervisor reports a restart, requests are held and then forwarded.
+	setState(gateway.UpstreamStarting)
+	before := hits.Load()
+	time.AfterFunc(300*time.Millisecond, func() {
+		if hits.Load() != before {
+			t.Errorf("request reached the upstream before it was ready")
+		}
+		setState(gateway.UpstreamRunning)
+	})
+	start := time.Now()
+	if code := do("POST"); code != http.StatusOK {
+		t.Fatalf("held POST: got=%d want=%d", code, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("request was not held: %v", elapsed)
+	}
+}
@@ -0,0 +1,222 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy controls how failed authentication attempts are throttled per remote IP.
+type LockoutPolicy struct {
+	// BaseDelay is how long the first failed attempt is delayed. Each further failure doubles it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxFailures is the number of failures within Window after which the IP is banned.
+	MaxFailures int
+	BanDuration time.Duration
+	// Window is how long a failure is remembered.
+	Window time.Duration
+}
+
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		BaseDelay:   250 * time.Millisecond,
+		MaxDelay:    8 * time.Second,
+		MaxFailures: 10,
+		BanDuration: 15 * time.Minute,
+		Window:      10 * time.Minute,
+	}
+}
+
+const maxLockoutEntries = 4096
+
+// Offender is a remote IP with recent authentication failures.
+type Offender struct {
+	IP              string `json:"ip"`
+	Failures        int    `json:"failures"`
+	LastFailureAtMs int64  `json:"lastFailureAtMs"`
+	BannedUntilMs   int64  `json:"bannedUntilMs,omitempty"`
+}
+
+// Lockout tracks authentication failures per remote IP, delays repeated failures exponentially
+// and bans IPs that keep failing.
+type Lockout struct {
+	policy LockoutPolicy
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+func NewLockout(policy LockoutPolicy) *Lockout {
+	return &Lockout{
+		policy:  policy,
+		now:     time.Now,
+		entries: make(map[string]*lockoutEntry),
+	}
+}
+
+// Banned reports whether ip is currently banned and for how much longer.
+func (l *Lockout) Banned(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.entryLocked(ip)
+	if e == nil {
+		return false, 0
+	}
+	if remaining := e.bannedUntil.Sub(l.now()); remaining > 0 {
+		return true, remaining
+	}
+	return false, 0
+}
+
+// Failure records a failed attempt and returns how long the response should be delayed, and
+// whether the IP is now banned.
+func (l *Lockout) Failure(ip string) (delay time.Duration, banned bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.entries) >= maxLockoutEntries {
+		l.sweepLocked()
+	}
+	e := l.entryLocked(ip)
+	if e == nil {
+		e = &lockoutEntry{}
+		l.entries[ip] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	if l.policy.MaxFailures > 0 && e.failures >= l.policy.MaxFailures {
+		e.bannedUntil = now.Add(l.policy.BanDuration)
+		return 0, true
+	}
+
+	delay = l.policy.BaseDelay
+	for i := 1; i < e.failures && delay < l.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.policy.MaxDelay {
+		delay = l.policy.MaxDelay
+	}
+	return delay, false
+}
+
+// Success forgets earlier failures for ip. Bans are not lifted.
+func (l *Lockout) Success(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[ip]; ok && !e.bannedUntil.After(l.now()) {
+		delete(l.entries, ip)
+	}
+}
+
+// Clear lifts a ban and forgets failures for ip. It reports whether ip was tracked.
+func (l *Lockout) Clear(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.entries[ip]
+	delete(l.entries, ip)
+	return ok
+}
+
+func (l *Lockout) ClearAll() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := len(l.entries)
+	l.entries = make(map[string]*lockoutEntry)
+	return n
+}
+
+// Snapshot returns the currently tracked offenders, banned ones first.
+func (l *Lockout) Snapshot() []Offender {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	out := make([]Offender, 0, len(l.entries))
+	for ip := range l.entries {
+		e := l.entryLocked(ip)
+		if e == nil {
+			continue
+		}
+		o := Offender{
+			IP:              ip,
+			Failures:        e.failures,
+			LastFailureAtMs: e.lastFailure.UnixMilli(),
+		}
+		if e.bannedUntil.After(now) {
+			o.BannedUntilMs = e.bannedUntil.UnixMilli()
+		}
+		out = append(out, o)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if (out[i].BannedUntilMs != 0) != (out[j].BannedUntilMs != 0) {
+			return out[i].BannedUntilMs != 0
+		}
+		return out[i].IP < out[j].IP
+	})
+	return out
+}
+
+// sweepLocked drops expired entries so a scan from many addresses cannot grow the map forever.
+func (l *Lockout) sweepLocked() {
+	for ip := range l.entries {
+		l.entryLocked(ip)
+	}
+}
+
+// entryLocked returns the entry for ip, dropping it first if both its ban and its failures
+// have expired.
+func (l *Lockout) entryLocked(ip string) *lockoutEntry {
+	e, ok := l.entries[ip]
+	if !ok {
+		return nil
+	}
+	now := l.now()
+	if !e.bannedUntil.After(now) && now.Sub(e.lastFailure) > l.policy.Window {
+		delete(l.entries, ip)
+		return nil
+	}
+	return e
+}
+
+// remoteIP returns the client IP used for lockout accounting.
+//
+// With Tailscale Serve, every request arrives from loopback and the tailnet client is the last
+// X-Forwarded-For entry. trustForwarded says whether Serve is in front of the gateway; without
+// it, any local process could pick a new address per attempt and never be banned. Even then the
+// header is only taken from loopback peers, and a loopback entry counts as the peer itself.
+func remoteIP(r *http.Request, trustForwarded bool) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustForwarded {
+		return host
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			fwd := strings.TrimSpace(parts[len(parts)-1])
+			if fip := net.ParseIP(fwd); fip != nil && !fip.IsLoopback() {
+				return fwd
+			}
+		}
+	}
+	return host
+}
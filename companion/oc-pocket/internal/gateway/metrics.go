@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/metrics"
+)
+
+// routeClasses are the first path segments of OpenCode routes that get their own class in
+// metrics. Everything else is "other" so clients cannot blow up the label space.
+var routeClasses = map[string]bool{
+	"agent": true, "app": true, "auth": true, "command": true, "config": true, "event": true,
+	"experimental": true, "file": true, "find": true, "global": true, "instance": true,
+	"log": true, "lsp": true, "mcp": true, "path": true, "permission": true, "project": true,
+	"provider": true, "pty": true, "question": true, "session": true, "tui": true, "vcs": true,
+}
+
+// routeClass groups a request for metrics: audited actions by name, the event streams, the
+// gateway's own endpoints, and other OpenCode routes by their first path segment. path is
+// escaped.
+func routeClass(method string, path string) string {
+	if action, _, ok := auditAction(method, path); ok {
+		return action
+	}
+	switch {
+	case path == healthPath:
+		return "health"
+	case strings.HasPrefix(path, adminPrefix):
+		return "admin"
+	case strings.HasPrefix(path, reservedPrefix):
+		return "reserved"
+	case path == globalEventPath || path == "/event":
+		return "events"
+	}
+	segments := splitPath(path)
+	if len(segments) > 0 && routeClasses[segments[0]] {
+		return segments[0]
+	}
+	return "other"
+}
+
+// gatewayMetrics records the gateway's metrics. A nil *gatewayMetrics records nothing.
+type gatewayMetrics struct {
+	requests       *metrics.Counter
+	latency        *metrics.Histogram
+	authFailures   *metrics.Counter
+	upstreamErrors *metrics.Counter
+	streams        atomic.Int64
+}
+
+func newGatewayMetrics(reg *metrics.Registry, s *Server) *gatewayMetrics {
+	m := &gatewayMetrics{
+		requests: reg.Counter("oc_pocket_http_requests_total",
+			"Requests handled by the gateway, by route class, method and status code.", "class", "method", "code"),
+		latency: reg.Histogram("oc_pocket_http_request_duration_seconds",
+			"Time until the response headers were sent, by route class.", metrics.DefaultBuckets, "class"),
+		authFailures: reg.Counter("oc_pocket_auth_failures_total",
+			"Rejected requests, by reason: invalid, revoked or locked_out.", "reason"),
+		upstreamErrors: reg.Counter("oc_pocket_upstream_errors_total",
+			"Requests that failed because OpenCode was unavailable or failed, by error code.", "code"),
+	}
+	reg.GaugeFunc("oc_pocket_sse_streams_active", "Event streams currently open.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(m.streams.Load())}}
+	})
+	reg.GaugeFunc("oc_pocket_upstream_ready", "1 if OpenCode is accepting requests.", nil, func() []metrics.Sample {
+		ready := 0.0
+		if s.upstreamReady() {
+			ready = 1
+		}
+		return []metrics.Sample{{Value: ready}}
+	})
+	reg.GaugeFunc("oc_pocket_upstream_state", "1 for the state OpenCode is in.", []string{"state"}, func() []metrics.Sample {
+		current := s.upstreamStatus().State
+		var samples []metrics.Sample
+		for _, state := range []UpstreamState{UpstreamStarting, UpstreamRunning, UpstreamCrashed, UpstreamStopped} {
+			v := 0.0
+			if state == current {
+				v = 1
+			}
+			samples = append(samples, metrics.Sample{Labels: []string{string(state)}, Value: v})
+		}
+		return samples
+	})
+	return m
+}
+
+func (m *gatewayMetrics) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w, onStream: func() { m.streams.Add(1) }}
+		next.ServeHTTP(rec, r)
+
+		if rec.streaming {
+			m.streams.Add(-1)
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		latency := time.Since(start)
+		if !rec.headerAt.IsZero() {
+			latency = rec.headerAt.Sub(start)
+		}
+		class := routeClass(r.Method, r.URL.EscapedPath())
+		m.requests.Inc(class, metricMethod(r.Method), strconv.Itoa(status))
+		m.latency.Observe(latency.Seconds(), class)
+	})
+}
+
+// metricMethod keeps unknown methods from adding label values.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+func (m *gatewayMetrics) authFailure(reason string) {
+	if m != nil {
+		m.authFailures.Inc(reason)
+	}
+}
+
+func (m *gatewayMetrics) upstreamError(code ErrorCode) {
+	if m != nil {
+		m.upstreamErrors.Inc(string(code))
+	}
+}
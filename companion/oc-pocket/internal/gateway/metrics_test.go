@@ -0,0 +1,100 @@
+package gateway_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/metrics"
+)
+
+func TestGateway_Metrics_CountRequestsStreamsAndFailures(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/event":
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprint(w, "data: hello\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case "/boom":
+			panic(http.ErrAbortHandler)
+		default:
+			_, _ = w.Write([]byte("{}"))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	reg := metrics.NewRegistry()
+	gw, err := gateway.New(gateway.Options{
+		ListenAddr:    "127.0.0.1:0",
+		Upstream:      upstream.URL,
+		Token:         "tok",
+		Metrics:       reg,
+		UpstreamReady: func() bool { return true },
+		HoldTimeout:   -1,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { _ = gw.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = gw.Start(ctx) }()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+	get := func(path string, token string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", gw.BaseURL()+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do(%s) error: %v", path, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	get("/session/ses_1", "tok")
+	get("/session", "tok")
+	get("/config", "wrong")
+	get("/boom", "tok")
+
+	streamCtx, stopStream := context.WithCancel(context.Background())
+	defer stopStream()
+	req, _ := http.NewRequestWithContext(streamCtx, "GET", gw.BaseURL()+"/event", nil)
+	req.Header.Set("Authorization", "Bearer tok")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do(/event) error: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+
+	var b strings.Builder
+	_ = reg.WriteText(&b)
+	out := b.String()
+	for _, want := range []string{
+		`oc_pocket_http_requests_total{class="session",method="GET",code="200"} 2`,
+		`oc_pocket_http_requests_total{class="config",method="GET",code="401"} 1`,
+		`oc_pocket_http_request_duration_seconds_count{class="session"} 2`,
+		`oc_pocket_auth_failures_total{reason="invalid"} 1`,
+		`oc_pocket_upstream_errors_total{code="upstream_error"} 1`,
+		`oc_pocket_sse_streams_active 1`,
+		`oc_pocket_upstream_ready 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+}
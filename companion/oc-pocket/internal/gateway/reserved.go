@@ -0,0 +1,189 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+)
+
+// Paths under reservedPrefix are served by the gateway itself and never proxied to OpenCode.
+const (
+	reservedPrefix = "/__oc-pocket/"
+	healthPath     = reservedPrefix + "health"
+	whoamiPath     = reservedPrefix + "whoami"
+	adminPrefix    = reservedPrefix + "admin/"
+)
+
+// Health is served unauthenticated at /__oc-pocket/health so clients can tell "gateway down"
+// from "bad token" from "OpenCode restarting". It must never include secrets.
+type Health struct {
+	Status      string         `json:"status"`
+	Version     string         `json:"version"`
+	StartedAtMs int64          `json:"startedAtMs"`
+	UptimeMs    int64          `json:"uptimeMs"`
+	Upstream    UpstreamHealth `json:"upstream"`
+}
+
+type UpstreamHealth struct {
+	Ready bool          `json:"ready"`
+	State UpstreamState `json:"state,omitempty"`
+}
+
+// WhoAmI is served at /__oc-pocket/whoami to authenticated clients.
+type WhoAmI struct {
+	Host         string   `json:"host"`
+	Device       string   `json:"device,omitempty"`
+	Scope        string   `json:"scope"`
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Health reports the gateway's current health.
+func (s *Server) Health() Health {
+	ready := s.upstreamReady()
+	status := "ok"
+	if !ready {
+		status = "upstream_unavailable"
+	}
+	return Health{
+		Status:      status,
+		Version:     s.opts.Version,
+		StartedAtMs: s.startedAt.UnixMilli(),
+		UptimeMs:    time.Since(s.startedAt).Milliseconds(),
+		Upstream:    UpstreamHealth{Ready: ready, State: s.upstreamStatus().State},
+	}
+}
+
+// capabilities lists optional gateway features so the app can adapt to older agents.
+func (s *Server) capabilities() []string {
+	caps := []string{"scopes", "health", "whoami"}
+	if s.opts.TLSConfig != nil {
+		caps = append(caps, "tls")
+	}
+	if s.opts.Admin != nil {
+		caps = append(caps, "admin")
+	}
+	return caps
+}
+
+func (s *Server) serveReserved(w http.ResponseWriter, r *http.Request, principal Principal) {
+	if strings.HasPrefix(r.URL.Path, adminPrefix) {
+		s.serveAdmin(w, r, principal)
+		return
+	}
+	switch r.URL.Path {
+	case whoamiPath:
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w)
+			return
+		}
+		writeJSON(w, http.StatusOK, WhoAmI{
+			Host:         s.opts.HostName,
+			Device:       principal.Device,
+			Scope:        string(principal.Scope),
+			Version:      s.opts.Version,
+			Capabilities: s.capabilities(),
+		})
+	default:
+		writeNotFound(w)
+	}
+}
+
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request, principal Principal) {
+	if s.opts.Admin == nil {
+		writeNotFound(w)
+		return
+	}
+	if !principal.Scope.Allows(config.ScopeAdmin) {
+		writeForbidden(w, fmt.Sprintf("forbidden: the admin API requires the %q scope; this device's token only has the %q scope", config.ScopeAdmin, principal.Scope))
+		return
+	}
+	aw := &adminErrorWriter{ResponseWriter: w}
+	http.StripPrefix(strings.TrimSuffix(adminPrefix, "/"), s.opts.Admin).ServeHTTP(aw, r)
+	aw.finish()
+}
+
+// adminErrorWriter rewrites the admin API's error responses, `{"error":"msg"}` from the control
+// API or ServeMux's plain-text 404 and 405, into the gateway's ErrorResponse. Successful
+// responses pass through untouched.
+type adminErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *adminErrorWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest {
+		w.status = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *adminErrorWriter) Write(p []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *adminErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *adminErrorWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+	msg := strings.ToLower(http.StatusText(w.status))
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(w.body.Bytes(), &e) == nil && e.Error != "" {
+		msg = e.Error
+	}
+	var code ErrorCode
+	switch {
+	case w.status == http.StatusNotFound:
+		code = CodeNotFound
+	case w.status == http.StatusMethodNotAllowed:
+		code = CodeMethodNotAllowed
+	case w.status < http.StatusInternalServerError:
+		code = CodeBadRequest
+	default:
+		code = CodeInternalError
+	}
+	writeError(w.ResponseWriter, w.status, code, msg, 0)
+}
+
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Health())
+}
+
+// dialReady reports whether something accepts TCP connections at addr.
+func dialReady(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, 500*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
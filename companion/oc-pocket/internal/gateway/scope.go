@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+)
+
+// scopeRule maps an upstream route to the scope it requires. In patterns, `*` matches exactly
+// one path segment. An empty method matches any method.
+type scopeRule struct {
+	method  string
+	pattern string
+	scope   config.Scope
+	action  string
+}
+
+var scopeRules = []scopeRule{
+	{http.MethodPost, "/session/*/message", config.ScopeChat, "sending prompts"},
+	{http.MethodPost, "/session/*/prompt_async", config.ScopeChat, "sending prompts"},
+	{http.MethodPost, "/session/*/command", config.ScopeChat, "running commands"},
+	{http.MethodPost, "/session/*/abort", config.ScopeChat, "aborting sessions"},
+	{http.MethodPost, "/session/*/revert", config.ScopeChat, "reverting sessions"},
+	{http.MethodPost, "/session/*/unrevert", config.ScopeChat, "reverting sessions"},
+	{http.MethodPost, "/session/*/fork", config.ScopeChat, "forking sessions"},
+	{http.MethodPost, "/permission/*/reply", config.ScopeChat, "replying to permission requests"},
+	{http.MethodPost, "/session/*/permissions/*", config.ScopeChat, "replying to permission requests"},
+
+	// Direct shell and terminal access bypasses the agent's permission prompts entirely.
+	{http.MethodPost, "/session/*/shell", config.ScopeAdmin, "running shell commands"},
+	{"", "/pty", config.ScopeAdmin, "using terminals"},
+	{"", "/pty/*", config.ScopeAdmin, "using terminals"},
+	{"", "/pty/*/connect", config.ScopeAdmin, "using terminals"},
+
+	{http.MethodPatch, "/config", config.ScopeAdmin, "changing OpenCode configuration"},
+	{"", "/auth/*", config.ScopeAdmin, "changing provider credentials"},
+	{http.MethodPost, "/instance/dispose", config.ScopeAdmin, "restarting OpenCode"},
+	{http.MethodPost, "/global/dispose", config.ScopeAdmin, "restarting OpenCode"},
+}
+
+// requiredScope returns the scope needed for a request and a human-readable description of
+// the action, used in 403 responses. escapedPath is the path as forwarded upstream
+// (URL.EscapedPath).
+func requiredScope(method string, escapedPath string) (config.Scope, string) {
+	segments := splitPath(escapedPath)
+	for _, rule := range scopeRules {
+		if rule.method != "" && rule.method != method {
+			continue
+		}
+		if matchSegments(splitPath(rule.pattern), segments) {
+			return rule.scope, rule.action
+		}
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return config.ScopeRead, "reading"
+	default:
+		return config.ScopeChat, "making changes"
+	}
+}
+
+// splitPath splits an escaped path into decoded segments the way the upstream router sees it.
+// It splits before decoding, so an encoded slash (`/session/a%2Fb/shell`) stays inside its
+// segment, and resolves empty and dot segments, so `//pty/x/connect` or `/a/%2e%2e/pty` cannot
+// be used to slip past a rule.
+func splitPath(escapedPath string) []string {
+	var segments []string
+	for _, seg := range strings.Split(escapedPath, "/") {
+		if decoded, err := url.PathUnescape(seg); err == nil {
+			seg = decoded
+		}
+		switch seg {
+		case "", ".":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) != len(segments) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != segments[i] {
+			return false
+		}
+	}
+	return true
+}
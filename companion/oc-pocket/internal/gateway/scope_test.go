@@ -0,0 +1,42 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+)
+
+func TestSplitPath_EncodedSeparatorsStayInSegment(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		method string
+		path   string
+		scope  config.Scope
+		action string
+		tmpl   string
+	}{
+		{http.MethodPost, "/session/ses_1/shell", config.ScopeAdmin, "shell", "/session/{id}/shell"},
+		{http.MethodPost, "/session/a%2Fb/shell", config.ScopeAdmin, "shell", "/session/a%2Fb/shell"},
+		{http.MethodPost, "/session/a%5Cb/shell", config.ScopeAdmin, "shell", "/session/a%5Cb/shell"},
+		{http.MethodPost, "/session/ses_1/%61bort", config.ScopeChat, "abort", "/session/{id}/abort"},
+		{http.MethodPost, "/session/x/%2e%2e/ses_1/abort", config.ScopeChat, "abort", "/session/{id}/abort"},
+		{http.MethodGet, "/session/ses_1/message", config.ScopeRead, "", "/session/{id}/message"},
+	}
+	for _, tc := range cases {
+		if scope, _ := requiredScope(tc.method, tc.path); scope != tc.scope {
+			t.Errorf("requiredScope(%s %s): got=%q want=%q", tc.method, tc.path, scope, tc.scope)
+		}
+		if action, _, _ := auditAction(tc.method, tc.path); action != tc.action {
+			t.Errorf("auditAction(%s %s): got=%q want=%q", tc.method, tc.path, action, tc.action)
+		}
+		if tmpl := pathTemplate(tc.path); tmpl != tc.tmpl {
+			t.Errorf("pathTemplate(%s): got=%q want=%q", tc.path, tmpl, tc.tmpl)
+		}
+	}
+
+	if _, session, _ := auditAction(http.MethodPost, "/session/a%2Fb/abort"); session != "a/b" {
+		t.Errorf("auditAction session: got=%q want=%q", session, "a/b")
+	}
+}
@@ -0,0 +1,182 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultSSEHeartbeat is how often an idle event stream gets a comment line. It is well below
+// the idle timeouts of carrier NATs and Tailscale DERP relays.
+const DefaultSSEHeartbeat = 15 * time.Second
+
+// sseHeartbeat is the SSE comment written to idle streams. Clients ignore comment lines.
+var sseHeartbeat = []byte(": heartbeat\n\n")
+
+var errStreamClosed = errors.New("event stream closed after a failed write")
+
+// sseWriter wraps the proxied response. Once the upstream answers with text/event-stream it
+// writes heartbeat comments whenever the stream has been idle for interval, and cancels the
+// request as soon as a write to the client fails so the upstream stream is torn down and the
+// client reconnects instead of sitting on a dead connection.
+type sseWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	interval time.Duration
+	cancel   context.CancelFunc
+
+	mu        sync.Mutex
+	streaming bool
+	failed    bool
+	lastWrite time.Time
+	// tail holds the last two bytes written so heartbeats are only inserted between events.
+	tail [2]byte
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSSEWriter(w http.ResponseWriter, interval time.Duration, cancel context.CancelFunc) *sseWriter {
+	return &sseWriter{
+		ResponseWriter: w,
+		rc:             http.NewResponseController(w),
+		interval:       interval,
+		cancel:         cancel,
+	}
+}
+
+func (w *sseWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if code == http.StatusOK && isEventStream(w.Header().Get("Content-Type")) && !w.streaming {
+		w.streaming = true
+		w.lastWrite = time.Now()
+		w.tail = [2]byte{'\n', '\n'}
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.heartbeat()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sseWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed {
+		return 0, errStreamClosed
+	}
+	if w.streaming {
+		_ = w.rc.SetWriteDeadline(time.Now().Add(w.writeTimeout()))
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		w.failLocked()
+		return n, err
+	}
+	w.lastWrite = time.Now()
+	switch {
+	case n >= 2:
+		w.tail = [2]byte{p[n-2], p[n-1]}
+	case n == 1:
+		w.tail = [2]byte{w.tail[1], p[0]}
+	}
+	return n, nil
+}
+
+func (w *sseWriter) Flush() {
+	_ = w.FlushError()
+}
+
+// FlushError is used by http.ResponseController so callers see failed flushes.
+func (w *sseWriter) FlushError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed {
+		return errStreamClosed
+	}
+	if err := w.rc.Flush(); err != nil {
+		w.failLocked()
+		return err
+	}
+	return nil
+}
+
+// Unwrap lets http.ResponseController and the reverse proxy reach the underlying writer,
+// e.g. to hijack upgraded connections.
+func (w *sseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close stops the heartbeat. It must be called before the handler returns.
+func (w *sseWriter) Close() {
+	w.mu.Lock()
+	stop, done := w.stop, w.done
+	w.stop = nil
+	w.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	// Keep-alive connections must not inherit the stream's write deadline.
+	_ = w.rc.SetWriteDeadline(time.Time{})
+}
+
+func (w *sseWriter) heartbeat() {
+	w.mu.Lock()
+	stop, done := w.stop, w.done
+	w.mu.Unlock()
+	defer close(done)
+
+	ticker := time.NewTicker(w.interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		if w.failed {
+			w.mu.Unlock()
+			return
+		}
+		// Never split an event: only write between events, i.e. after a blank line.
+		if time.Since(w.lastWrite) >= w.interval && w.tail == [2]byte{'\n', '\n'} {
+			_ = w.rc.SetWriteDeadline(time.Now().Add(w.writeTimeout()))
+			_, err := w.ResponseWriter.Write(sseHeartbeat)
+			if err == nil {
+				err = w.rc.Flush()
+			}
+			if err != nil {
+				w.failLocked()
+				w.mu.Unlock()
+				return
+			}
+			w.lastWrite = time.Now()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// writeTimeout bounds how long a single write to a stalled client may block.
+func (w *sseWriter) writeTimeout() time.Duration {
+	return 2 * w.interval
+}
+
+func (w *sseWriter) failLocked() {
+	w.failed = true
+	w.cancel()
+}
+
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/event-stream"
+}
@@ -0,0 +1,37 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestSSEWriter_FailedHeartbeatCancelsStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := newSSEWriter(brokenWriter{httptest.NewRecorder()}, 20*time.Millisecond, cancel)
+	defer w.Close()
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("a failed heartbeat write should cancel the proxied request")
+	}
+	if _, err := w.Write([]byte("data: late\n\n")); err == nil {
+		t.Fatalf("writes after a failure should return an error")
+	}
+}
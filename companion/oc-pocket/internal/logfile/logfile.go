@@ -0,0 +1,244 @@
+// Package logfile implements the agent's size-rotated log files.
+//
+// A log is a current file plus up to Keep rotated segments next to it: agent.log, agent.log.1
+// (the most recent), agent.log.2, ... Rotated segments are optionally gzipped (agent.log.1.gz).
+// Every line is prefixed with a timestamp and its source so logs can be filtered and merged.
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TimeFormat is the timestamp at the start of every line.
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Options controls rotation.
+type Options struct {
+	// MaxBytes is the size at which the current file is rotated. Zero or less never rotates.
+	MaxBytes int64
+	// Keep is how many rotated segments are kept; older ones are deleted.
+	Keep int
+	// Compress gzips rotated segments.
+	Compress bool
+}
+
+// Rotator is an io.WriteCloser appending to a file that is rotated by size. It is safe for
+// concurrent use; each Write lands in a single segment.
+type Rotator struct {
+	path string
+	opts Options
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens (or creates) the log at path for appending.
+func Open(path string, opts Options) (*Rotator, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	r := &Rotator{path: path, opts: opts}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Rotator) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *Rotator) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.opts.MaxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.opts.MaxBytes {
+		// On failure, keep appending to the current file rather than losing lines. Errors cannot
+		// be reported on stderr, which may itself be written to this log.
+		if err := r.rotate(); err != nil && r.f == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *Rotator) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// rotate shifts every segment up by one, dropping the oldest, and starts a new current file.
+func (r *Rotator) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	if r.opts.Keep <= 0 {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return r.open()
+	}
+
+	for _, ext := range []string{"", ".gz"} {
+		_ = os.Remove(segmentPath(r.path, r.opts.Keep) + ext)
+	}
+	for i := r.opts.Keep - 1; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			from := segmentPath(r.path, i) + ext
+			if err := os.Rename(from, segmentPath(r.path, i+1)+ext); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	first := segmentPath(r.path, 1)
+	if err := os.Rename(r.path, first); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.opts.Compress {
+		return compress(first)
+	}
+	return nil
+}
+
+func segmentPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// compress replaces path with path.gz.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Segments returns the files of the log at path that exist, oldest first, ending with the
+// current file.
+func Segments(path string) []string {
+	var segments []string
+	for i := 1; ; i++ {
+		found := ""
+		for _, p := range []string{segmentPath(path, i), segmentPath(path, i) + ".gz"} {
+			if _, err := os.Stat(p); err == nil {
+				found = p
+				break
+			}
+		}
+		if found == "" {
+			break
+		}
+		segments = append([]string{found}, segments...)
+	}
+	if _, err := os.Stat(path); err == nil {
+		segments = append(segments, path)
+	}
+	return segments
+}
+
+// maxLineBytes bounds how much of a line without a newline is buffered before it is written.
+const maxLineBytes = 64 << 10
+
+// lineWriter prefixes every line written to it with a timestamp and a source.
+type lineWriter struct {
+	w      io.Writer
+	source string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// NewLineWriter returns a writer that writes each line as "<timestamp> <source>: <line>" to w.
+// A trailing partial line is held back until its newline arrives.
+func NewLineWriter(w io.Writer, source string) io.Writer {
+	return &lineWriter{w: w, source: source}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, b := range p {
+		if b == '\n' || len(l.buf) >= maxLineBytes {
+			if err := l.flushLocked(); err != nil {
+				return 0, err
+			}
+			if b == '\n' {
+				continue
+			}
+		}
+		l.buf = append(l.buf, b)
+	}
+	return len(p), nil
+}
+
+func (l *lineWriter) flushLocked() error {
+	line := make([]byte, 0, len(TimeFormat)+len(l.source)+len(l.buf)+4)
+	line = time.Now().UTC().AppendFormat(line, TimeFormat)
+	line = append(line, ' ')
+	line = append(line, l.source...)
+	line = append(line, ": "...)
+	line = append(line, l.buf...)
+	line = append(line, '\n')
+	l.buf = l.buf[:0]
+	_, err := l.w.Write(line)
+	return err
+}
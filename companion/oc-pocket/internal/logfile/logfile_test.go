@@ -0,0 +1,101 @@
+package logfile_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/logfile"
+)
+
+func TestRotator_RotatesBySizeAndKeepsSegments(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "logs", "agent.log")
+	r, err := logfile.Open(path, logfile.Options{MaxBytes: 10, Keep: 2, Compress: true})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, line := range []string{"one 12345\n", "two 12345\n", "three 123\n", "four 1234\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	segments := logfile.Segments(path)
+	want := []string{path + ".2.gz", path + ".1.gz", path}
+	if strings.Join(segments, ",") != strings.Join(want, ",") {
+		t.Fatalf("segments: got=%v want=%v", segments, want)
+	}
+
+	// "one" was dropped with the oldest segment.
+	var got []string
+	for _, seg := range segments {
+		got = append(got, readSegment(t, seg))
+	}
+	if strings.Join(got, "") != "two 12345\nthree 123\nfour 1234\n" {
+		t.Fatalf("contents: got=%q", got)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("perm: got=%04o want=0600", perm)
+	}
+}
+
+func TestLineWriter_PrefixesCompleteLines(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w := logfile.NewLineWriter(&buf, "opencode")
+	_, _ = w.Write([]byte("hello\nwor"))
+	_, _ = w.Write([]byte("ld\npartial"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines: got=%q", buf.String())
+	}
+	for i, text := range []string{"hello", "world"} {
+		ts, rest, ok := strings.Cut(lines[i], " ")
+		if !ok || rest != "opencode: "+text {
+			t.Fatalf("line %d: got=%q", i, lines[i])
+		}
+		if _, err := time.Parse(logfile.TimeFormat, ts); err != nil {
+			t.Fatalf("line %d timestamp: %v", i, err)
+		}
+	}
+}
+
+func readSegment(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip %s: %v", path, err)
+		}
+		r = zr
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return string(raw)
+}
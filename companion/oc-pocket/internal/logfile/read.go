@@ -0,0 +1,234 @@
+package logfile
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Line is a log line split into the parts NewLineWriter writes.
+type Line struct {
+	// Time is zero if the line does not start with a timestamp.
+	Time   time.Time
+	Source string
+	Text   string
+}
+
+// ParseLine splits a line written by NewLineWriter. Other lines are returned as Text only.
+func ParseLine(s string) Line {
+	ts, rest, ok := strings.Cut(s, " ")
+	if !ok {
+		return Line{Text: s}
+	}
+	t, err := time.Parse(TimeFormat, ts)
+	if err != nil {
+		return Line{Text: s}
+	}
+	source, text, ok := strings.Cut(rest, ": ")
+	if !ok {
+		return Line{Time: t, Text: rest}
+	}
+	return Line{Time: t, Source: source, Text: text}
+}
+
+// Cursor reads a log line by line across its rotated segments, oldest first, and then keeps
+// reading the current file as it grows and is rotated.
+type Cursor struct {
+	path string
+	// segments holds the rotated segments not read yet. They are opened up front so a rotation
+	// while reading cannot rename them away.
+	segments []*os.File
+	live     *os.File
+
+	f       *os.File
+	r       *bufio.Reader
+	partial string
+}
+
+// OpenCursor opens the log at path. A log that does not exist yet reads as empty.
+func OpenCursor(path string) (*Cursor, error) {
+	c := &Cursor{path: path}
+	for _, seg := range Segments(path) {
+		f, err := os.Open(seg)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if seg == path {
+			c.live = f
+		} else {
+			c.segments = append(c.segments, f)
+		}
+	}
+	return c, nil
+}
+
+// Next returns the next complete line. ok is false once everything written so far has been
+// read; calling Next again later returns lines written since.
+func (c *Cursor) Next() (line string, ok bool, err error) {
+	for {
+		if c.r == nil && !c.advance() {
+			return "", false, nil
+		}
+
+		s, err := c.r.ReadString('\n')
+		if err == nil {
+			line := c.partial + strings.TrimSuffix(s, "\n")
+			c.partial = ""
+			return line, true, nil
+		}
+		if !errors.Is(err, io.EOF) {
+			return "", false, err
+		}
+		c.partial += s
+
+		if c.f != c.live {
+			// A rotated segment is complete; move on to the next one.
+			_ = c.f.Close()
+			c.f, c.r = nil, nil
+			if line := c.partial; line != "" {
+				c.partial = ""
+				return line, true, nil
+			}
+			continue
+		}
+
+		if !c.rotated() {
+			return "", false, nil
+		}
+		// The file we were reading has been rotated away and fully read; continue with whatever
+		// was rotated after it, then the new current file.
+		c.segments = c.newerSegments(c.live)
+		_ = c.live.Close()
+		c.live, c.f, c.r = nil, nil, nil
+		if line := c.partial; line != "" {
+			c.partial = ""
+			return line, true, nil
+		}
+	}
+}
+
+// advance starts reading the next segment, or the current file. It reports false if there is
+// nothing to read.
+func (c *Cursor) advance() bool {
+	switch {
+	case len(c.segments) > 0:
+		c.f, c.segments = c.segments[0], c.segments[1:]
+		var r io.Reader = c.f
+		if strings.HasSuffix(c.f.Name(), ".gz") {
+			zr, err := gzip.NewReader(c.f)
+			if err != nil {
+				_ = c.f.Close()
+				c.f = nil
+				return c.advance()
+			}
+			r = zr
+		}
+		c.r = bufio.NewReader(r)
+		return true
+	case c.live == nil:
+		// The log did not exist when the cursor was opened, or was rotated away.
+		f, err := os.Open(c.path)
+		if err != nil {
+			return false
+		}
+		c.live = f
+		fallthrough
+	default:
+		c.f = c.live
+		c.r = bufio.NewReader(c.live)
+		return true
+	}
+}
+
+// rotated reports whether the current file at path is no longer the one being read.
+func (c *Cursor) rotated() bool {
+	cur, err := c.live.Stat()
+	if err != nil {
+		return true
+	}
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		// Removed and not recreated yet; keep reading the old file until it is.
+		return false
+	}
+	return !os.SameFile(cur, fi)
+}
+
+// newerSegments opens the segments rotated after old, in case the log was rotated more than
+// once since it was last read. A compressed segment is a new file and cannot be matched to
+// old, so then only the current file is read.
+func (c *Cursor) newerSegments(old *os.File) []*os.File {
+	oldInfo, err := old.Stat()
+	if err != nil {
+		return nil
+	}
+	var newer []*os.File
+	found := false
+	for _, seg := range Segments(c.path) {
+		if seg == c.path {
+			break
+		}
+		if !found {
+			fi, err := os.Stat(seg)
+			found = err == nil && os.SameFile(oldInfo, fi)
+			continue
+		}
+		if f, err := os.Open(seg); err == nil {
+			newer = append(newer, f)
+		}
+	}
+	return newer
+}
+
+func (c *Cursor) Close() {
+	for _, f := range c.segments {
+		_ = f.Close()
+	}
+	c.segments = nil
+	if c.f != nil && c.f != c.live {
+		_ = c.f.Close()
+	}
+	if c.live != nil {
+		_ = c.live.Close()
+	}
+	c.f, c.live, c.r = nil, nil, nil
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	bearerPattern     = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	tokenParamPattern = regexp.MustCompile(`(?i)((?:token|access_token)=)[^&\s"]+`)
+)
+
+// Redactor removes credentials from log lines: bearer tokens, token query parameters and any
+// of a set of known secrets.
+type Redactor struct {
+	secrets *strings.Replacer
+}
+
+// NewRedactor returns a Redactor that also replaces every secret in secrets.
+func NewRedactor(secrets []string) *Redactor {
+	var pairs []string
+	for _, s := range secrets {
+		if s != "" {
+			pairs = append(pairs, s, redacted)
+		}
+	}
+	return &Redactor{secrets: strings.NewReplacer(pairs...)}
+}
+
+func (r *Redactor) Redact(line string) string {
+	line = r.secrets.Replace(line)
+	line = bearerPattern.ReplaceAllString(line, "${1}"+redacted)
+	return tokenParamPattern.ReplaceAllString(line, "${1}"+redacted)
+}
@@ -0,0 +1,146 @@
+package logfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/logfile"
+)
+
+func TestCursor_ReadsSegmentsThenFollowsRotation(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "agent.log")
+	r, err := logfile.Open(path, logfile.Options{MaxBytes: 10, Keep: 3})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+	write := func(line string) {
+		t.Helper()
+		if _, err := r.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	for _, line := range []string{"one 12345", "two 12345", "three 123"} {
+		write(line)
+	}
+
+	c, err := logfile.OpenCursor(path)
+	if err != nil {
+		t.Fatalf("OpenCursor: %v", err)
+	}
+	defer c.Close()
+	readAll := func() []string {
+		t.Helper()
+		var lines []string
+		for {
+			line, ok, err := c.Next()
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			if !ok {
+				return lines
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if got := readAll(); len(got) != 3 || got[0] != "one 12345" || got[2] != "three 123" {
+		t.Fatalf("initial: got=%q", got)
+	}
+
+	// The current file is rotated away twice while it is being followed.
+	write("four 1234")
+	write("five 1234")
+	if got := readAll(); len(got) != 2 || got[0] != "four 1234" || got[1] != "five 1234" {
+		t.Fatalf("after rotation: got=%q", got)
+	}
+}
+
+func TestCursor_ReadsCompressedSegments(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "agent.log")
+	r, err := logfile.Open(path, logfile.Options{MaxBytes: 10, Keep: 3, Compress: true})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, line := range []string{"one 12345\n", "two 12345\n", "three 123\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	_ = r.Close()
+
+	c, err := logfile.OpenCursor(path)
+	if err != nil {
+		t.Fatalf("OpenCursor: %v", err)
+	}
+	defer c.Close()
+	var got []string
+	for {
+		line, ok, err := c.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, line)
+	}
+	if len(got) != 3 || got[0] != "one 12345" || got[1] != "two 12345" || got[2] != "three 123" {
+		t.Fatalf("got=%q", got)
+	}
+}
+
+func TestCursor_MissingLogIsEmptyUntilCreated(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "opencode.log")
+	c, err := logfile.OpenCursor(path)
+	if err != nil {
+		t.Fatalf("OpenCursor: %v", err)
+	}
+	defer c.Close()
+	if _, ok, err := c.Next(); ok || err != nil {
+		t.Fatalf("missing: ok=%v err=%v", ok, err)
+	}
+
+	if err := os.WriteFile(path, []byte("hello\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if line, ok, err := c.Next(); !ok || err != nil || line != "hello" {
+		t.Fatalf("created: line=%q ok=%v err=%v", line, ok, err)
+	}
+}
+
+func TestRedactor_RemovesTokens(t *testing.T) {
+	t.Parallel()
+
+	r := logfile.NewRedactor([]string{"s3cret-device-token"})
+	cases := map[string]string{
+		"Authorization: Bearer abc.def-123":         "Authorization: Bearer [REDACTED]",
+		"GET /global/event?token=abc&x=1":           "GET /global/event?token=[REDACTED]&x=1",
+		"pairing string has s3cret-device-token in": "pairing string has [REDACTED] in",
+		"nothing to hide":                           "nothing to hide",
+	}
+	for in, want := range cases {
+		if got := r.Redact(in); got != want {
+			t.Fatalf("%q: got=%q want=%q", in, got, want)
+		}
+	}
+}
+
+func TestParseLine_SplitsTimestampAndSource(t *testing.T) {
+	t.Parallel()
+
+	l := logfile.ParseLine("2026-01-02T03:04:05.678Z gateway: banned 10.0.0.1")
+	if l.Time.IsZero() || l.Source != "gateway" || l.Text != "banned 10.0.0.1" {
+		t.Fatalf("got=%+v", l)
+	}
+	if l := logfile.ParseLine("panic: boom"); !l.Time.IsZero() || l.Text != "panic: boom" {
+		t.Fatalf("unprefixed: got=%+v", l)
+	}
+}
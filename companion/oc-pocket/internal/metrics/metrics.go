@@ -0,0 +1,250 @@
+// Package metrics is a small registry that renders the Prometheus text exposition format for
+// the agent's /metrics endpoint. It covers what the agent needs and nothing more: labelled
+// counters and histograms updated as things happen, and gauges or counters read from their
+// owner at scrape time.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds, from fast API calls to slow model requests.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Sample is one value of a metric read at scrape time. Labels are in the order the metric
+// declared them.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics in the order they were registered. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, typ: "counter", labels: labels}, values: map[string]*float64{}}
+	r.register(c)
+	return c
+}
+
+// Histogram registers a histogram with the given upper bounds, in increasing order.
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name: name, help: help, typ: "histogram", labels: labels}, buckets: buckets, values: map[string]*histogramValue{}}
+	r.register(h)
+	return h
+}
+
+// GaugeFunc registers a gauge whose samples are read from collect on every scrape.
+func (r *Registry) GaugeFunc(name string, help string, labels []string, collect func() []Sample) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, collect: collect})
+}
+
+// CounterFunc registers an unlabelled counter whose value is read from collect on every
+// scrape.
+func (r *Registry) CounterFunc(name string, help string, collect func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, typ: "counter"}, collect: func() []Sample {
+		return []Sample{{Value: collect()}}
+	}})
+}
+
+// WriteText writes every metric in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WriteText(w)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, strings.ReplaceAll(d.help, "\n", " "), d.name, d.typ)
+}
+
+// key joins label values into a map key.
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series renders name{labels...}, with extra name/value pairs appended.
+func (d desc) series(name string, values []string, extra ...string) string {
+	var pairs []string
+	for i, label := range d.labels {
+		pairs = append(pairs, label+`="`+escape(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitKey(key string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+// Counter is a monotonically increasing value per label combination.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*float64
+}
+
+// Inc adds one for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.values[key]
+	if !ok {
+		p = new(float64)
+		c.values[key] = p
+	}
+	*p += v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s %s\n", c.series(c.name, splitKey(key, len(c.labels))), formatFloat(*c.values[key]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets per label combination.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		values := splitKey(key, len(h.labels))
+		hv := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", values, "le", formatFloat(upper)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", values, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s %s\n", h.series(h.name+"_sum", values), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_count", values), hv.count)
+	}
+}
+
+type funcMetric struct {
+	desc
+	collect func() []Sample
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	for _, s := range m.collect() {
+		fmt.Fprintf(w, "%s %s\n", m.series(m.name, s.Labels), formatFloat(s.Value))
+	}
+}
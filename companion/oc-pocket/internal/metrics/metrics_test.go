@@ -0,0 +1,50 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/metrics"
+)
+
+func TestRegistry_WritesTextFormat(t *testing.T) {
+	t.Parallel()
+
+	reg := metrics.NewRegistry()
+	requests := reg.Counter("requests_total", "Requests.", "class", "code")
+	latency := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, "class")
+	reg.GaugeFunc("ready", "Ready.", nil, func() []metrics.Sample { return []metrics.Sample{{Value: 1}} })
+	reg.CounterFunc("restarts_total", "Restarts.", func() float64 { return 2 })
+
+	requests.Inc("session", "200")
+	requests.Inc("session", "200")
+	requests.Inc(`we"ird`, "500")
+	latency.Observe(0.05, "session")
+	latency.Observe(0.5, "session")
+
+	var b strings.Builder
+	if err := reg.WriteText(&b); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{class="session",code="200"} 2
+requests_total{class="we\"ird",code="500"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{class="session",le="0.1"} 1
+latency_seconds_bucket{class="session",le="1"} 2
+latency_seconds_bucket{class="session",le="+Inf"} 2
+latency_seconds_sum{class="session"} 0.55
+latency_seconds_count{class="session"} 2
+# HELP ready Ready.
+# TYPE ready gauge
+ready 1
+# HELP restarts_total Restarts.
+# TYPE restarts_total counter
+restarts_total 2
+`
+	if b.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
@@ -8,11 +8,16 @@ import (
 
 const (
 	LaunchAgentLabel    = "com.ratulsarna.oc-pocket"
+	SystemdUnitName     = "oc-pocket.service"
 	DefaultGatewayPort  = 4096
 	DefaultOpenCodePort = 4097
 	configDirName       = "oc-pocket"
 )
 
+// Version is the oc-pocket version, overridden at build time with
+// -ldflags "-X github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/ocmobile.Version=...".
+var Version = "dev"
+
 func ConfigDir(override string) (string, error) {
 	if override != "" {
 		return filepath.Abs(override)
@@ -32,6 +37,15 @@ func LaunchAgentPlistPath() (string, error) {
 	return filepath.Join(home, "Library", "LaunchAgents", LaunchAgentLabel+".plist"), nil
 }
 
+// SystemdUnitPath returns where the systemd user unit is installed.
+func SystemdUnitPath() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "systemd", "user", SystemdUnitName), nil
+}
+
 func DefaultDeviceName() string {
 	if h, err := os.Hostname(); err == nil && h != "" {
 		return h
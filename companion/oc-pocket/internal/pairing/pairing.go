@@ -15,6 +15,12 @@ type Payload struct {
 	Token     string `json:"token"`
 	Name      string `json:"name,omitempty"`
 	CreatedAt int64  `json:"createdAtMs,omitempty"`
+	// Scope is the token's scope (read|chat|admin) so the app can hide controls it cannot use.
+	// Empty means full access (pairing strings issued before scopes existed).
+	Scope string `json:"scope,omitempty"`
+	// CertSHA256 is the hex SHA-256 fingerprint of the CA that issued the gateway's certificate
+	// when the gateway serves HTTPS itself. The app pins it instead of trusting the system store.
+	CertSHA256 string `json:"certSha256,omitempty"`
 }
 
 const prefixV1 = "oc-pocket-pair:v1:"
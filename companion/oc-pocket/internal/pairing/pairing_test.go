@@ -15,6 +15,7 @@ func TestEncodeDecode_RoundTrip(t *testing.T) {
 		BaseURL: "https://example.ts.net",
 		Token:   "tok_123",
 		Name:    "My Mac",
+		Scope:   "read",
 	}
 
 	s, err := pairing.Encode(payload)
@@ -26,7 +27,7 @@ func TestEncodeDecode_RoundTrip(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Decode() error: %v", err)
 	}
-	if got.BaseURL != payload.BaseURL || got.Token != payload.Token || got.Name != payload.Name || got.Version != payload.Version {
+	if got.BaseURL != payload.BaseURL || got.Token != payload.Token || got.Name != payload.Name || got.Version != payload.Version || got.Scope != payload.Scope {
 		t.Fatalf("payload mismatch: got=%+v want=%+v", got, payload)
 	}
 }
@@ -0,0 +1,114 @@
+// Package status decides the overall state `oc-pocket status` reports, and the exit code
+// scripts depend on, from what the CLI found out about an install.
+package status
+
+import (
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/agent"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+)
+
+// Exit codes of `oc-pocket status`, so scripts can tell the states apart. 1 and 2 keep their
+// usual meaning (error, bad usage).
+const (
+	ExitHealthy    = 0
+	ExitNotSetUp   = 3
+	ExitNotRunning = 4
+	ExitDegraded   = 5
+)
+
+const (
+	Healthy    = "healthy"
+	Degraded   = "degraded"
+	NotRunning = "not-running"
+	NotSetUp   = "not-set-up"
+)
+
+// Report is everything `oc-pocket status` knows, printed as is by `status --json`.
+type Report struct {
+	// State is Healthy, Degraded, NotRunning or NotSetUp.
+	State string `json:"state"`
+	// Problems explains a state other than healthy.
+	Problems      []string           `json:"problems,omitempty"`
+	ConfigDir     string             `json:"configDir"`
+	Config        *config.Config     `json:"config,omitempty"`
+	ActiveDevices int                `json:"activeDevices"`
+	Service       Service            `json:"service"`
+	Agent         *agent.AgentHealth `json:"agent,omitempty"`
+	Lockouts      []gateway.Offender `json:"lockouts,omitempty"`
+	// Status is the agent's status.json, which may be left over from an agent that is gone.
+	Status *agent.Status `json:"status,omitempty"`
+
+	// ConfigErr is why the config could not be loaded; AgentErr why the agent did not answer.
+	ConfigErr error `json:"-"`
+	AgentErr  error `json:"-"`
+}
+
+// Service is the service manager's view of the agent.
+type Service struct {
+	Manager string `json:"manager"`
+	Label   string `json:"label"`
+	Running bool   `json:"running"`
+	State   string `json:"state"`
+	// Kind names the service in messages, e.g. "LaunchAgent".
+	Kind string `json:"-"`
+}
+
+// Assess sets the report's State and Problems from what was collected.
+func (r *Report) Assess() {
+	r.State, r.Problems = r.assess()
+}
+
+func (r *Report) assess() (state string, problems []string) {
+	if r.Config == nil {
+		msg := "config: not found"
+		if r.ConfigErr != nil {
+			msg = "config: " + r.ConfigErr.Error()
+		}
+		return NotSetUp, []string{msg}
+	}
+
+	if r.Agent == nil {
+		msg := "agent not reachable"
+		if r.AgentErr != nil {
+			msg += ": " + r.AgentErr.Error()
+		}
+		problems = append(problems, msg)
+		if !r.Service.Running {
+			problems = append(problems, r.Service.Kind+" not running: "+r.Service.State)
+		}
+		return NotRunning, problems
+	}
+
+	if up := r.Agent.Upstream; !up.Ready {
+		msg := "opencode not ready"
+		if up.State != "" {
+			msg += " (" + string(up.State) + ")"
+		}
+		if r.Status != nil && r.Status.LastError != "" {
+			msg += ": " + r.Status.LastError
+		}
+		problems = append(problems, msg)
+	}
+	if r.Status != nil && r.Status.Tailscale != nil && r.Status.Tailscale.Error != "" {
+		problems = append(problems, "tailscale: "+r.Status.Tailscale.Error)
+	}
+	if len(problems) > 0 {
+		return Degraded, problems
+	}
+	return Healthy, nil
+}
+
+// ExitCode returns the exit code for the report's State.
+func (r Report) ExitCode() int {
+	switch r.State {
+	case NotSetUp:
+		return ExitNotSetUp
+	case NotRunning:
+		return ExitNotRunning
+	case Degraded:
+		return ExitDegraded
+	default:
+		return ExitHealthy
+	}
+}
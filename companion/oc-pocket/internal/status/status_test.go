@@ -0,0 +1,108 @@
+package status_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/agent"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/control"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/status"
+)
+
+func TestReport_AssessStatesAndExitCodes(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{Mode: config.ModeTailscale}
+	health := func(ready bool, state gateway.UpstreamState) *agent.AgentHealth {
+		return &agent.AgentHealth{Health: gateway.Health{Upstream: gateway.UpstreamHealth{Ready: ready, State: state}}}
+	}
+	service := status.Service{Manager: "launchd", Kind: "LaunchAgent"}
+
+	cases := []struct {
+		name     string
+		report   status.Report
+		state    string
+		exit     int
+		problems []string
+	}{
+		{
+			name:     "not set up",
+			report:   status.Report{ConfigErr: errors.New("config.json: no such file or directory"), Service: service},
+			state:    status.NotSetUp,
+			exit:     status.ExitNotSetUp,
+			problems: []string{"config: config.json: no such file or directory"},
+		},
+		{
+			name: "agent unreachable",
+			report: status.Report{
+				Config:   cfg,
+				Service:  status.Service{Manager: "systemd", Kind: "systemd user unit", State: "inactive"},
+				AgentErr: control.ErrAgentNotRunning,
+			},
+			state:    status.NotRunning,
+			exit:     status.ExitNotRunning,
+			problems: []string{"agent not reachable: " + control.ErrAgentNotRunning.Error(), "systemd user unit not running: inactive"},
+		},
+		{
+			name: "agent unreachable while the service runs",
+			report: status.Report{
+				Config:   cfg,
+				Service:  status.Service{Manager: "launchd", Kind: "LaunchAgent", Running: true, State: "running"},
+				AgentErr: control.ErrAgentNotRunning,
+			},
+			state:    status.NotRunning,
+			exit:     status.ExitNotRunning,
+			problems: []string{"agent not reachable: " + control.ErrAgentNotRunning.Error()},
+		},
+		{
+			name: "opencode not ready",
+			report: status.Report{
+				Config:  cfg,
+				Service: service,
+				Agent:   health(false, gateway.UpstreamCrashed),
+				Status:  &agent.Status{LastError: "opencode exited: exit status 1"},
+			},
+			state:    status.Degraded,
+			exit:     status.ExitDegraded,
+			problems: []string{"opencode not ready (crashed): opencode exited: exit status 1"},
+		},
+		{
+			name: "tailscale error",
+			report: status.Report{
+				Config:  cfg,
+				Service: service,
+				Agent:   health(true, gateway.UpstreamRunning),
+				Status:  &agent.Status{Tailscale: &agent.TailscaleStatus{Error: "not logged in"}},
+			},
+			state:    status.Degraded,
+			exit:     status.ExitDegraded,
+			problems: []string{"tailscale: not logged in"},
+		},
+		{
+			name: "healthy",
+			report: status.Report{
+				Config:  cfg,
+				Service: service,
+				Agent:   health(true, gateway.UpstreamRunning),
+				Status:  &agent.Status{Tailscale: &agent.TailscaleStatus{LoggedIn: true, Serve: true}},
+			},
+			state: status.Healthy,
+			exit:  status.ExitHealthy,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := tc.report
+			r.Assess()
+			if r.State != tc.state || r.ExitCode() != tc.exit {
+				t.Fatalf("state=%q exit=%d; want state=%q exit=%d", r.State, r.ExitCode(), tc.state, tc.exit)
+			}
+			if strings.Join(r.Problems, "\n") != strings.Join(tc.problems, "\n") {
+				t.Fatalf("problems: got=%q want=%q", r.Problems, tc.problems)
+			}
+		})
+	}
+}
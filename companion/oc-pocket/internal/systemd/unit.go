@@ -0,0 +1,135 @@
+// Package systemd renders the systemd user unit that runs the agent on Linux.
+package systemd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type UnitOptions struct {
+	Description string
+	Program     string
+	ProgramArgs []string
+	// Environment is set for the agent. A `--user` service does not inherit the login shell's
+	// environment, so e.g. PATH has to be passed for OpenCode to find its tools.
+	Environment map[string]string
+	// EnvironmentFile is read by systemd when the agent starts, so values kept there (like PATH)
+	// can change without rewriting the unit. A missing file is ignored.
+	EnvironmentFile string
+	StdoutPath      string
+	StderrPath      string
+	// Restart is the systemd restart policy, e.g. "always" or "on-failure". RestartSec is the
+	// delay between restarts.
+	Restart    string
+	RestartSec time.Duration
+}
+
+func RenderUnit(opts UnitOptions) ([]byte, error) {
+	if opts.Program == "" {
+		return nil, errors.New("Program is required")
+	}
+	words := append([]string{opts.Program, opts.Description, opts.EnvironmentFile, opts.StdoutPath, opts.StderrPath}, opts.ProgramArgs...)
+	for k, v := range opts.Environment {
+		words = append(words, k, v)
+	}
+	for _, w := range words {
+		if strings.ContainsAny(w, "\n") {
+			return nil, fmt.Errorf("%q: unit settings must not contain newlines", w)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("[Unit]\n")
+	if opts.Description != "" {
+		fmt.Fprintf(&b, "Description=%s\n", escapeSpecifiers(opts.Description))
+	}
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("\n")
+
+	b.WriteString("[Service]\n")
+	b.WriteString("Type=simple\n")
+	args := []string{quoteExec(opts.Program)}
+	for _, arg := range opts.ProgramArgs {
+		args = append(args, quoteExec(arg))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+
+	keys := make([]string, 0, len(opts.Environment))
+	for k := range opts.Environment {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "Environment=%s\n", quote(k+"="+opts.Environment[k]))
+	}
+	if opts.EnvironmentFile != "" {
+		fmt.Fprintf(&b, "EnvironmentFile=-%s\n", escapeSpecifiers(opts.EnvironmentFile))
+	}
+
+	if opts.Restart != "" {
+		fmt.Fprintf(&b, "Restart=%s\n", opts.Restart)
+	}
+	if opts.RestartSec > 0 {
+		fmt.Fprintf(&b, "RestartSec=%s\n", formatSeconds(opts.RestartSec))
+	}
+	// Only the agent gets SIGTERM; it stops OpenCode itself within its shutdown grace period.
+	b.WriteString("KillMode=mixed\n")
+	if opts.StdoutPath != "" {
+		fmt.Fprintf(&b, "StandardOutput=append:%s\n", escapeSpecifiers(opts.StdoutPath))
+	}
+	if opts.StderrPath != "" {
+		fmt.Fprintf(&b, "StandardError=append:%s\n", escapeSpecifiers(opts.StderrPath))
+	}
+	b.WriteString("\n")
+
+	b.WriteString("[Install]\n")
+	b.WriteString("WantedBy=default.target\n")
+	return b.Bytes(), nil
+}
+
+var envFileEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+
+// RenderEnvironmentFile renders env in the format EnvironmentFile= reads.
+func RenderEnvironmentFile(env map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(env))
+	for k, v := range env {
+		if strings.ContainsAny(k+v, "\n") {
+			return nil, fmt.Errorf("%q: environment values must not contain newlines", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		// Double-quoted values follow shell rules: specifiers are not expanded, but ${VARIABLES} are.
+		fmt.Fprintf(&b, "%s=\"%s\"\n", k, envFileEscaper.Replace(env[k]))
+	}
+	return b.Bytes(), nil
+}
+
+// quote quotes a word for Environment=, escaping the specifiers systemd would otherwise
+// expand.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(escapeSpecifiers(s)) + `"`
+}
+
+// quoteExec quotes a word for ExecStart=, which also expands $VARIABLES.
+func quoteExec(s string) string {
+	return quote(strings.ReplaceAll(s, "$", "$$"))
+}
+
+func escapeSpecifiers(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+func formatSeconds(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%d", int64(d/time.Second))
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
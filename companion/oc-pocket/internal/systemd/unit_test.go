@@ -0,0 +1,83 @@
+package systemd_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/systemd"
+)
+
+func TestRenderUnit_IncludesExecStartRestartAndLogs(t *testing.T) {
+	t.Parallel()
+
+	b, err := systemd.RenderUnit(systemd.UnitOptions{
+		Description:     "oc-pocket agent",
+		Program:         "/abs/path/to/oc-pocket",
+		ProgramArgs:     []string{"agent", "--config-dir", "/home/me/.config/oc-pocket"},
+		Environment:     map[string]string{"PATH": "/usr/local/bin:/usr/bin"},
+		EnvironmentFile: "/home/me/.config/oc-pocket/agent.env",
+		StdoutPath:      "/home/me/.config/oc-pocket/agent.stdout.log",
+		StderrPath:      "/home/me/.config/oc-pocket/agent.stderr.log",
+		Restart:         "always",
+		RestartSec:      2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("RenderUnit() error: %v", err)
+	}
+
+	s := string(b)
+	for _, want := range []string{
+		`ExecStart="/abs/path/to/oc-pocket" "agent" "--config-dir" "/home/me/.config/oc-pocket"` + "\n",
+		`Environment="PATH=/usr/local/bin:/usr/bin"` + "\n",
+		"EnvironmentFile=-/home/me/.config/oc-pocket/agent.env\n",
+		"Restart=always\n",
+		"RestartSec=2\n",
+		"StandardOutput=append:/home/me/.config/oc-pocket/agent.stdout.log\n",
+		"StandardError=append:/home/me/.config/oc-pocket/agent.stderr.log\n",
+		"WantedBy=default.target\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("unit missing %q:\n%s", want, s)
+		}
+	}
+}
+
+func TestRenderUnit_EscapesSpecifiersAndVariables(t *testing.T) {
+	t.Parallel()
+
+	b, err := systemd.RenderUnit(systemd.UnitOptions{
+		Program:     "/opt/100%/oc-pocket",
+		ProgramArgs: []string{`$HOME "quoted"`},
+	})
+	if err != nil {
+		t.Fatalf("RenderUnit() error: %v", err)
+	}
+	if want := `ExecStart="/opt/100%%/oc-pocket" "$$HOME \"quoted\""` + "\n"; !strings.Contains(string(b), want) {
+		t.Fatalf("unit missing %q:\n%s", want, b)
+	}
+
+	if _, err := systemd.RenderUnit(systemd.UnitOptions{Program: "/bin/x", ProgramArgs: []string{"a\nExecStartPre=/bin/evil"}}); err == nil {
+		t.Fatalf("expected an error for a newline in an argument")
+	}
+}
+
+func TestRenderEnvironmentFile_QuotesValues(t *testing.T) {
+	t.Parallel()
+
+	b, err := systemd.RenderEnvironmentFile(map[string]string{
+		"PATH": `/opt/my "tools"/bin:/usr/bin`,
+		"HOME": `/home/$me\100%`,
+	})
+	if err != nil {
+		t.Fatalf("RenderEnvironmentFile() error: %v", err)
+	}
+	want := `HOME="/home/\$me\\100%"` + "\n" + `PATH="/opt/my \"tools\"/bin:/usr/bin"` + "\n"
+	if got := string(b); got != want {
+		t.Fatalf("RenderEnvironmentFile() = %q, want %q", got, want)
+	}
+
+	if _, err := systemd.RenderEnvironmentFile(map[string]string{"PATH": "a\nb"}); err == nil {
+		t.Fatalf("RenderEnvironmentFile() accepted a newline")
+	}
+}
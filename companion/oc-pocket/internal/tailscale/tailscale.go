@@ -116,6 +116,51 @@ func (c Client) TryConfigureServe(ctx context.Context, port int) (configured boo
 	return true, nil
 }
 
+// ServesPort reports whether Tailscale Serve proxies to the given local port, i.e. whether
+// TryConfigureServe (or a manual `tailscale serve`) is still in effect.
+func (c Client) ServesPort(ctx context.Context, port int) (bool, error) {
+	if c.Runner == nil {
+		return false, errors.New("Runner is required")
+	}
+
+	cmd, userCmd := c.resolveBinary()
+	stdout, stderr, _, err := c.Runner.Run(ctx, cmd, "serve", "status", "--json")
+	if err != nil {
+		return false, actionableExecError(userCmd, err, stderr)
+	}
+	if strings.TrimSpace(stdout) == "" {
+		// Nothing is being served.
+		return false, nil
+	}
+
+	var sc struct {
+		Web map[string]struct {
+			Handlers map[string]struct {
+				Proxy string `json:"Proxy"`
+			} `json:"Handlers"`
+		} `json:"Web"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &sc); err != nil {
+		return false, fmt.Errorf("%w: could not read `%s serve status --json`: %v", ErrStatusUnreadable, userCmd, err)
+	}
+	want := map[string]bool{
+		fmt.Sprintf("127.0.0.1:%d", port): true,
+		fmt.Sprintf("localhost:%d", port): true,
+	}
+	for _, web := range sc.Web {
+		for _, h := range web.Handlers {
+			target := h.Proxy
+			if i := strings.Index(target, "://"); i >= 0 {
+				target = target[i+3:]
+			}
+			if want[strings.TrimSuffix(target, "/")] {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 func (c Client) resolveBinary() (runCmd string, userCmd string) {
 	if strings.TrimSpace(c.Binary) != "" {
 		return c.Binary, c.Binary
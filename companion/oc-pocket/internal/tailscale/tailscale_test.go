@@ -30,3 +30,21 @@ func TestGetStatus_MissingBinary_ReturnsActionableError(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestServesPort_MatchesProxyTarget(t *testing.T) {
+	t.Parallel()
+
+	const serveStatus = `{"TCP":{"443":{"HTTPS":true}},"Web":{"mac.tail1234.ts.net:443":{"Handlers":{"/":{"Proxy":"http://127.0.0.1:4096"}}}}}`
+	client := tailscale.Client{Binary: "tailscale", Runner: fakeRunner{
+		run: func(_ string, _ ...string) (string, string, int, error) {
+			return serveStatus, "", 0, nil
+		},
+	}}
+
+	if ok, err := client.ServesPort(context.Background(), 4096); err != nil || !ok {
+		t.Fatalf("ServesPort(4096): got=%t err=%v want=true", ok, err)
+	}
+	if ok, err := client.ServesPort(context.Background(), 4097); err != nil || ok {
+		t.Fatalf("ServesPort(4097): got=%t err=%v want=false", ok, err)
+	}
+}
@@ -0,0 +1,286 @@
+// Package tlsutil manages the locally generated CA and gateway certificate used when the
+// gateway serves HTTPS directly (LAN mode and Tailscale-IP fallback).
+//
+// The app pins the CA fingerprint from the pairing payload instead of trusting the system
+// store, so the leaf can be re-issued (e.g. when the Mac gets a new LAN IP) without re-pairing.
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/fsutil"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/netutil"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 397 * 24 * time.Hour
+	// leafRenewBefore re-issues the leaf this long before it expires.
+	leafRenewBefore = 30 * 24 * time.Hour
+)
+
+// Bundle is the gateway's certificate chain plus the CA fingerprint to pin.
+type Bundle struct {
+	Certificate   tls.Certificate
+	CAFingerprint string
+}
+
+// ServerConfig returns a TLS config serving the bundle's certificate chain.
+func (b *Bundle) ServerConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{b.Certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// Dir returns where certificates are stored inside the config dir.
+func Dir(configDir string) string {
+	return filepath.Join(configDir, "tls")
+}
+
+// Fingerprint returns the lowercase hex SHA-256 of a DER-encoded certificate.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// CAFingerprint returns the fingerprint of the CA stored in dir.
+func CAFingerprint(dir string) (string, error) {
+	ca, _, err := loadPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(ca.Raw), nil
+}
+
+// AppendCA adds the CA stored in dir to pool so local clients can verify the gateway.
+func AppendCA(pool *x509.CertPool, dir string) error {
+	ca, _, err := loadPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return err
+	}
+	pool.AddCert(ca)
+	return nil
+}
+
+// LocalNames returns the IPs and DNS names the gateway certificate should cover: loopback,
+// every LAN and tailnet IPv4 of this machine, and the host name.
+func LocalNames() (ips []string, dnsNames []string) {
+	ips = append(ips, "127.0.0.1")
+	ips = append(ips, netutil.LocalIPv4s()...)
+	ips = append(ips, netutil.CGNATIPv4s()...)
+
+	dnsNames = append(dnsNames, "localhost")
+	if h, err := os.Hostname(); err == nil && h != "" {
+		dnsNames = append(dnsNames, h)
+		if !strings.Contains(h, ".") {
+			dnsNames = append(dnsNames, h+".local")
+		}
+	}
+	return ips, dnsNames
+}
+
+// Ensure loads or creates the CA and a leaf certificate covering ips and dnsNames.
+// The CA is created once and reused; the leaf is re-issued when it is missing, close to
+// expiry, not signed by the CA or does not cover every requested name.
+func Ensure(dir string, ips []string, dnsNames []string, now time.Time) (*Bundle, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	caCertPath := filepath.Join(dir, "ca.pem")
+	caKeyPath := filepath.Join(dir, "ca-key.pem")
+	leafCertPath := filepath.Join(dir, "cert.pem")
+	leafKeyPath := filepath.Join(dir, "key.pem")
+
+	ca, caKey, err := loadPair(caCertPath, caKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		ca, caKey, err = createCA(caCertPath, caKeyPath, now)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tls ca: %w", err)
+	}
+
+	parsedIPs := make([]net.IP, 0, len(ips))
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", s)
+		}
+		parsedIPs = append(parsedIPs, ip)
+	}
+
+	leaf, leafKey, err := loadPair(leafCertPath, leafKeyPath)
+	if err != nil || !leafUsable(leaf, ca, parsedIPs, dnsNames, now) {
+		leaf, leafKey, err = createLeaf(leafCertPath, leafKeyPath, ca, caKey, parsedIPs, dnsNames, now)
+		if err != nil {
+			return nil, fmt.Errorf("tls cert: %w", err)
+		}
+	}
+
+	return &Bundle{
+		Certificate: tls.Certificate{
+			Certificate: [][]byte{leaf.Raw, ca.Raw},
+			PrivateKey:  leafKey,
+			Leaf:        leaf,
+		},
+		CAFingerprint: Fingerprint(ca.Raw),
+	}, nil
+}
+
+func leafUsable(leaf *x509.Certificate, ca *x509.Certificate, ips []net.IP, dnsNames []string, now time.Time) bool {
+	if leaf.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	if now.Before(leaf.NotBefore) || now.Add(leafRenewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	for _, want := range ips {
+		found := false
+		for _, have := range leaf.IPAddresses {
+			if have.Equal(want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, want := range dnsNames {
+		found := false
+		for _, have := range leaf.DNSNames {
+			if have == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func createCA(certPath string, keyPath string, now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "oc-pocket local CA " + hostname, Organization: []string{"oc-pocket"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return writePair(certPath, keyPath, der, key)
+}
+
+func createLeaf(certPath string, keyPath string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, ips []net.IP, dnsNames []string, now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "oc-pocket gateway", Organization: []string{"oc-pocket"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  ips,
+		DNSNames:     dnsNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return writePair(certPath, keyPath, der, key)
+}
+
+func writePair(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Each file is replaced atomically. A crash between the two still leaves a new key next
+	// to the old certificate, which loadPair rejects so the pair is issued again.
+	if err := fsutil.AtomicWriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return nil, nil, err
+	}
+	if err := fsutil.AtomicWriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func loadPair(certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("%s: no PEM data", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("%s: no PEM data", keyPath)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, nil, fmt.Errorf("%s does not match %s: %w", keyPath, certPath, err)
+	}
+	return cert, key, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,104 @@
+package tlsutil_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/tlsutil"
+)
+
+func TestEnsure_ReusesCA_AndReissuesLeafForNewIP(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	now := time.Now()
+
+	first, err := tlsutil.Ensure(dir, []string{"127.0.0.1", "192.168.1.10"}, []string{"localhost"}, now)
+	if err != nil {
+		t.Fatalf("Ensure() error: %v", err)
+	}
+	again, err := tlsutil.Ensure(dir, []string{"192.168.1.10"}, nil, now)
+	if err != nil {
+		t.Fatalf("Ensure(again) error: %v", err)
+	}
+	if !again.Certificate.Leaf.Equal(first.Certificate.Leaf) {
+		t.Fatalf("leaf should be reused when it already covers every name")
+	}
+
+	moved, err := tlsutil.Ensure(dir, []string{"127.0.0.1", "10.0.0.7"}, []string{"localhost"}, now)
+	if err != nil {
+		t.Fatalf("Ensure(new IP) error: %v", err)
+	}
+	if moved.Certificate.Leaf.Equal(first.Certificate.Leaf) {
+		t.Fatalf("leaf should be re-issued for a new IP")
+	}
+	if moved.CAFingerprint != first.CAFingerprint {
+		t.Fatalf("CA fingerprint changed: got=%s want=%s", moved.CAFingerprint, first.CAFingerprint)
+	}
+
+	fp, err := tlsutil.CAFingerprint(dir)
+	if err != nil {
+		t.Fatalf("CAFingerprint() error: %v", err)
+	}
+	if fp != first.CAFingerprint || len(fp) != 64 {
+		t.Fatalf("CAFingerprint: got=%q want=%q", fp, first.CAFingerprint)
+	}
+
+	ca, err := x509.ParseCertificate(moved.Certificate.Certificate[1])
+	if err != nil {
+		t.Fatalf("parse CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err := moved.Certificate.Leaf.Verify(x509.VerifyOptions{DNSName: "10.0.0.7", Roots: roots}); err != nil {
+		t.Fatalf("leaf does not verify against CA: %v", err)
+	}
+}
+
+func TestEnsure_ReissuesLeafWhenKeyDoesNotMatch(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	now := time.Now()
+	first, err := tlsutil.Ensure(dir, []string{"127.0.0.1"}, []string{"localhost"}, now)
+	if err != nil {
+		t.Fatalf("Ensure() error: %v", err)
+	}
+
+	// A crash after the new key was written but before its certificate was leaves a key that
+	// does not belong to cert.pem.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error: %v", err)
+	}
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	again, err := tlsutil.Ensure(dir, []string{"127.0.0.1"}, []string{"localhost"}, now)
+	if err != nil {
+		t.Fatalf("Ensure(again) error: %v", err)
+	}
+	if again.Certificate.Leaf.Equal(first.Certificate.Leaf) {
+		t.Fatalf("leaf should be re-issued when its key does not match")
+	}
+	if _, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), keyPath); err != nil {
+		t.Fatalf("stored pair does not match: %v", err)
+	}
+	if again.CAFingerprint != first.CAFingerprint {
+		t.Fatalf("CA fingerprint changed: got=%s want=%s", again.CAFingerprint, first.CAFingerprint)
+	}
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
@@ -17,13 +26,19 @@ import (
 	"github.com/mdp/qrterminal/v3"
 
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/agent"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/audit"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/config"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/control"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/doctor"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/executil"
-	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/launchd"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/gateway"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/logfile"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/netutil"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/ocmobile"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/pairing"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/status"
 	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/tailscale"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/tlsutil"
 )
 
 func main() {
@@ -41,12 +56,22 @@ func run(args []string) int {
 		return cmdSetup(args[1:])
 	case "status":
 		return cmdStatus(args[1:])
+	case "doctor":
+		return cmdDoctor(args[1:])
+	case "logs":
+		return cmdLogs(args[1:])
+	case "audit":
+		return cmdAudit(args[1:])
 	case "restart":
 		return cmdRestart(args[1:])
 	case "uninstall":
 		return cmdUninstall(args[1:])
 	case "token":
 		return cmdToken(args[1:])
+	case "devices":
+		return cmdDevices(args[1:])
+	case "lockouts":
+		return cmdLockouts(args[1:])
 	case "agent":
 		return cmdAgent(args[1:])
 	default:
@@ -57,14 +82,22 @@ func run(args []string) int {
 }
 
 func printUsage() {
-	fmt.Println("oc-pocket (macOS companion CLI)")
+	fmt.Println("oc-pocket " + ocmobile.Version + " (companion CLI for macOS and Linux)")
 	fmt.Println()
 	fmt.Println("Usage:")
-	fmt.Println("  oc-pocket setup")
-	fmt.Println("  oc-pocket status")
-	fmt.Println("  oc-pocket restart")
+	fmt.Println("  oc-pocket setup [--tls]")
+	fmt.Println("  oc-pocket status [--json]")
+	fmt.Println("  oc-pocket doctor")
+	fmt.Println("  oc-pocket logs [--follow] [--source agent|opencode|gateway] [--since 10m]")
+	fmt.Println("  oc-pocket audit [--session <id>] [--since 24h|<time>] [--until <time>] [--json]")
+	fmt.Println("  oc-pocket restart [--opencode]")
 	fmt.Println("  oc-pocket uninstall")
-	fmt.Println("  oc-pocket token rotate")
+	fmt.Println("  oc-pocket token rotate [--device <name>]")
+	fmt.Println("  oc-pocket devices list")
+	fmt.Println("  oc-pocket devices add [--scope read|chat|admin] <name>")
+	fmt.Println("  oc-pocket devices revoke <name>")
+	fmt.Println("  oc-pocket lockouts list")
+	fmt.Println("  oc-pocket lockouts clear <ip>|--all")
 	fmt.Println()
 	fmt.Println("Internal:")
 	fmt.Println("  oc-pocket agent")
@@ -77,7 +110,18 @@ func cmdSetup(args []string) int {
 	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
 	opencodePathFlag := fs.String("opencode-path", "", "path to `opencode` binary (optional)")
 	defaultDirFlag := fs.String("default-dir", "", "directory to start OpenCode in (optional; defaults to a safe oc-pocket workdir)")
-	skipLaunchdFlag := fs.Bool("skip-launchd", false, "do not install/run LaunchAgent (advanced)")
+	skipServiceFlag := fs.Bool("skip-service", false, "do not install/run the LaunchAgent or systemd unit (advanced)")
+	fs.BoolVar(skipServiceFlag, "skip-launchd", false, "alias of --skip-service")
+	deviceFlag := fs.String("device", config.DefaultDevice, "name of the device to pair")
+	tlsFlag := fs.Bool("tls", false, "serve HTTPS with a locally generated, pinned certificate when not behind Tailscale Serve")
+	sseHeartbeatFlag := fs.Duration("sse-heartbeat", gateway.DefaultSSEHeartbeat, "heartbeat interval for idle event streams (0 disables)")
+	holdTimeoutFlag := fs.Duration("hold-timeout", gateway.DefaultHoldTimeout, "how long requests wait for OpenCode to restart (0 disables)")
+	logMaxSizeFlag := fs.Int("log-max-size", agent.DefaultLogMaxSizeMB, "size in MB at which log files are rotated (0 never rotates)")
+	logKeepFlag := fs.Int("log-keep", agent.DefaultLogKeep, "how many rotated log files to keep")
+	logCompressFlag := fs.Bool("log-compress", false, "gzip rotated log files")
+	metricsPortFlag := fs.Int("metrics-port", 0, "serve Prometheus metrics on 127.0.0.1 at this port (0 disables)")
+	accessLogFlag := fs.Bool("access-log", false, "log every gateway request as a JSON line to logs/access.log")
+	shutdownGraceFlag := fs.Duration("shutdown-grace", agent.DefaultShutdownGrace, "how long OpenCode gets to exit after SIGTERM before it is killed (0 kills immediately)")
 	if err := fs.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return 0
@@ -89,6 +133,11 @@ func cmdSetup(args []string) int {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	if err := config.ValidateDeviceName(*deviceFlag); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
 	mode, err := resolveMode(*modeFlag)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -123,20 +172,25 @@ func cmdSetup(args []string) int {
 		}
 	}
 
-	// Prefer reusing an existing token so re-running `setup` does not force re-pairing.
-	// Use `oc-pocket token rotate` if you intentionally want a new token.
-	token := ""
-	if raw, err := os.ReadFile(filepath.Join(configDir, "token")); err == nil {
-		token = strings.TrimSpace(string(raw))
+	store := config.Store{BaseDir: configDir}
+	registry := store.Devices()
+	if _, err := registry.MigrateLegacyToken(time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
 	}
-	if token == "" {
-		var err error
-		token, err = pairing.GenerateToken()
+
+	// Prefer reusing an existing device token so re-running `setup` does not force re-pairing.
+	// Use `oc-pocket token rotate` if you intentionally want a new token.
+	device, err := registry.Get(*deviceFlag)
+	if err != nil || device.Revoked() {
+		// The device paired during setup belongs to the Mac's owner, so it gets full access.
+		device, err = addDevice(registry, *deviceFlag, config.ScopeAdmin)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return 1
 		}
 	}
+	token := device.Token
 
 	cfg := config.Config{
 		Mode:             mode,
@@ -144,94 +198,110 @@ func cmdSetup(args []string) int {
 		OpenCodePort:     ocmobile.DefaultOpenCodePort,
 		OpenCodePath:     opencodePath,
 		DefaultDirectory: defaultDirectory,
-	}
-
-	store := config.Store{BaseDir: configDir}
-	if err := store.Save(cfg, token); err != nil {
+		TLS:              *tlsFlag,
+	}
+	cfg.SSEHeartbeatSeconds = durationSetting(*sseHeartbeatFlag, gateway.DefaultSSEHeartbeat)
+	cfg.HoldTimeoutSeconds = durationSetting(*holdTimeoutFlag, gateway.DefaultHoldTimeout)
+	cfg.ShutdownGraceSeconds = durationSetting(*shutdownGraceFlag, agent.DefaultShutdownGrace)
+	cfg.LogMaxSizeMB = intSetting(*logMaxSizeFlag, agent.DefaultLogMaxSizeMB)
+	cfg.LogKeep = intSetting(*logKeepFlag, agent.DefaultLogKeep)
+	cfg.LogCompress = *logCompressFlag
+	cfg.AccessLog = *accessLogFlag
+	cfg.MetricsPort = max(*metricsPortFlag, 0)
+
+	if err := store.Save(cfg); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return 1
 	}
 
-	// For OSS users installing from GitHub Releases, oc-pocket won't live inside a git repo.
-	// If we're inside the repo, build a stable binary at companion/oc-pocket/bin/oc-pocket for launchd.
-	// Otherwise, use the currently running executable.
-	binPath := ""
-	if repoRoot, err := ocmobile.FindRepoRoot(); err == nil {
-		if err := buildRepoBinary(ctx, repoRoot); err != nil {
+	if cfg.TLS {
+		// Create the CA now so the pairing string can carry its fingerprint; the agent re-issues
+		// the leaf on start if this machine's IPs changed.
+		ips, dnsNames := tlsutil.LocalNames()
+		if _, err := tlsutil.Ensure(tlsutil.Dir(configDir), ips, dnsNames, time.Now()); err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return 1
 		}
-		binPath = ocmobile.RepoBinaryPath(repoRoot)
-	} else {
-		exe, err := os.Executable()
-		if err != nil || strings.TrimSpace(exe) == "" {
-			fmt.Fprintln(os.Stderr, "Could not determine oc-pocket executable path.")
+	}
+
+	binPath, repoRoot, err := agentBinaryPath()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if repoRoot != "" {
+		if err := buildRepoBinary(ctx, repoRoot); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
 			return 1
 		}
-		binPath = exe
 	}
 
-	stdoutPath := filepath.Join(configDir, "agent.stdout.log")
-	stderrPath := filepath.Join(configDir, "agent.stderr.log")
-	plistBytes, err := launchd.RenderPlist(launchd.PlistOptions{
-		Label:       ocmobile.LaunchAgentLabel,
-		Program:     binPath,
-		ProgramArgs: []string{"agent", "--config-dir", configDir},
-		RunAtLoad:   true,
-		KeepAlive:   true,
-		StdoutPath:  stdoutPath,
-		StderrPath:  stderrPath,
-	})
+	svc := currentService()
+	defBytes, err := svc.Render(binPath, configDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defPath, err := svc.DefinitionPath()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return 1
 	}
 
-	exitCode := 0
-	if !*skipLaunchdFlag {
-		plistPath, err := ocmobile.LaunchAgentPlistPath()
-		if err != nil {
+	if sd, ok := svc.(systemdService); ok {
+		if err := sd.writeEnvironment(configDir); err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return 1
 		}
-		if err := os.MkdirAll(filepath.Dir(plistPath), 0o755); err != nil {
+	}
+
+	exitCode := 0
+	if !*skipServiceFlag {
+		if err := os.MkdirAll(filepath.Dir(defPath), 0o755); err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return 1
 		}
-		if err := os.WriteFile(plistPath, plistBytes, 0o644); err != nil {
+		if err := os.WriteFile(defPath, defBytes, 0o644); err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return 1
 		}
 
-		if err := launchctlBootstrap(ctx, plistPath); err != nil {
+		if err := svc.Install(ctx, defPath); err != nil {
 			exitCode = 1
 			fmt.Fprintln(os.Stderr, err.Error())
 			fmt.Fprintln(os.Stderr, "")
-			fmt.Fprintln(os.Stderr, "LaunchAgent install failed. You can still run the agent manually in a separate terminal:")
+			fmt.Fprintln(os.Stderr, svc.Kind()+" install failed. You can still run the agent manually in a separate terminal:")
 			fmt.Fprintln(os.Stderr, "  "+binPath+" agent --config-dir "+strconv.Quote(configDir))
 			fmt.Fprintln(os.Stderr, "")
-			fmt.Fprintln(os.Stderr, "Or re-run setup with --skip-launchd to avoid launchctl entirely.")
+			fmt.Fprintln(os.Stderr, "Or re-run setup with --skip-service to avoid "+svc.Manager()+" entirely.")
+		} else if sd, ok := svc.(systemdService); ok {
+			if hint := sd.lingerHint(ctx); hint != "" {
+				fmt.Println(hint)
+			}
 		}
 	} else {
-		plistPath := filepath.Join(configDir, "com.ratulsarna.oc-pocket.plist")
-		if err := os.WriteFile(plistPath, plistBytes, 0o644); err != nil {
+		defPath = filepath.Join(configDir, filepath.Base(defPath))
+		if err := os.WriteFile(defPath, defBytes, 0o644); err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 			return 1
 		}
-		fmt.Println("LaunchAgent not installed (skip-launchd). Plist written to:")
-		fmt.Println("  " + plistPath)
+		fmt.Println(svc.Kind() + " not installed (skip-service). Service definition written to:")
+		fmt.Println("  " + defPath)
 	}
 
-	baseURL, extraURLs, warn := computePairingBaseURL(ctx, cfg.Mode, cfg.GatewayPort)
+	baseURL, extraURLs, warn := computePairingBaseURL(ctx, cfg.Mode, cfg.GatewayPort, cfg.TLS)
 	if warn != "" {
 		fmt.Fprintln(os.Stderr, warn)
 	}
 
+	certSHA256 := certFingerprint(cfg, configDir, baseURL)
 	payload, err := pairing.Encode(pairing.Payload{
-		Version: 1,
-		BaseURL: baseURL,
-		Token:   token,
-		Name:    ocmobile.DefaultDeviceName(),
+		Version:    1,
+		BaseURL:    baseURL,
+		Token:      token,
+		Name:       ocmobile.DefaultDeviceName(),
+		Scope:      string(device.EffectiveScope()),
+		CertSHA256: certSHA256,
 	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -239,7 +309,7 @@ func cmdSetup(args []string) int {
 	}
 
 	fmt.Println()
-	fmt.Println("Pair with iPhone:")
+	fmt.Println("Pair with iPhone (device: " + *deviceFlag + "):")
 	fmt.Println()
 	fmt.Println("Pairing string (copy/paste):")
 	fmt.Println("  " + payload)
@@ -249,6 +319,11 @@ func cmdSetup(args []string) int {
 	fmt.Println()
 	fmt.Println("Base URL:")
 	fmt.Println("  " + baseURL)
+	if certSHA256 != "" {
+		fmt.Println()
+		fmt.Println("Certificate SHA-256 (pinned by the app):")
+		fmt.Println("  " + certSHA256)
+	}
 	if len(extraURLs) > 0 {
 		fmt.Println()
 		fmt.Println("Other candidate URLs:")
@@ -264,6 +339,21 @@ func cmdSetup(args []string) int {
 	return exitCode
 }
 
+// agentBinaryPath returns the binary the agent service runs. For OSS users installing from GitHub
+// Releases, oc-pocket won't live inside a git repo. If we're inside the repo, setup builds a
+// stable binary at companion/oc-pocket/bin/oc-pocket for the service (repoRoot is set). Otherwise,
+// use the currently running executable.
+func agentBinaryPath() (binPath string, repoRoot string, err error) {
+	if repoRoot, err := ocmobile.FindRepoRoot(); err == nil {
+		return ocmobile.RepoBinaryPath(repoRoot), repoRoot, nil
+	}
+	exe, err := os.Executable()
+	if err != nil || strings.TrimSpace(exe) == "" {
+		return "", "", errors.New("Could not determine oc-pocket executable path.")
+	}
+	return exe, "", nil
+}
+
 func cmdAgent(args []string) int {
 	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
 	configDirFlag := fs.String("config-dir", "", "override config dir")
@@ -282,7 +372,7 @@ func cmdAgent(args []string) int {
 	}
 
 	store := config.Store{BaseDir: configDir}
-	cfg, token, err := store.Load()
+	cfg, err := store.Load()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return 1
@@ -294,11 +384,28 @@ func cmdAgent(args []string) int {
 	runner := executil.NewRunner()
 	ts := tailscale.Client{Runner: runner}
 
+	// The agent owns its log files so they can be rotated; the service's stdout/stderr
+	// files only catch what is written before this point (and crashes).
+	var opencodeLog, gatewayLog, accessLog io.Writer
+	if logs, err := agent.OpenLogs(configDir, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "oc-pocket: logs unavailable: "+err.Error())
+	} else {
+		defer func() { _ = logs.Close() }()
+		if err := logs.CaptureStdio(); err != nil {
+			fmt.Fprintln(os.Stderr, "oc-pocket: logs unavailable: "+err.Error())
+		}
+		opencodeLog = logs.OpenCodeLog()
+		gatewayLog = logs.GatewayLog()
+		accessLog = logs.AccessLog()
+	}
+
 	if err := agent.Run(ctx, agent.Options{
-		ConfigDir: configDir,
-		Config:    cfg,
-		Token:     token,
-		Tailscale: ts,
+		ConfigDir:   configDir,
+		Config:      cfg,
+		Tailscale:   ts,
+		OpenCodeLog: opencodeLog,
+		GatewayLog:  gatewayLog,
+		AccessLog:   accessLog,
 	}); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return 1
@@ -309,6 +416,7 @@ func cmdAgent(args []string) int {
 func cmdStatus(args []string) int {
 	fs := flag.NewFlagSet("status", flag.ContinueOnError)
 	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	jsonFlag := fs.Bool("json", false, "print a single JSON document (exit code: 0 healthy, 3 not set up, 4 not running, 5 degraded)")
 	if err := fs.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return 0
@@ -323,30 +431,109 @@ func cmdStatus(args []string) int {
 		return 1
 	}
 
+	report := collectStatus(context.Background(), configDir)
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		return report.ExitCode()
+	}
+
+	if report.Config == nil {
+		fmt.Fprintln(os.Stderr, "Not set up yet. Run: oc-pocket setup")
+		return report.ExitCode()
+	}
+	printStatus(report)
+	return report.ExitCode()
+}
+
+func collectStatus(ctx context.Context, configDir string) status.Report {
+	svc := currentService()
+	r := status.Report{
+		ConfigDir: configDir,
+		Service:   status.Service{Manager: svc.Manager(), Label: svc.Label(), Kind: svc.Kind()},
+	}
+
 	store := config.Store{BaseDir: configDir}
-	cfg, _, err := store.Load()
+	cfg, err := store.Load()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Not set up yet. Run: oc-pocket setup")
-		return 1
+		r.ConfigErr = err
+		r.Assess()
+		return r
+	}
+	r.Config = &cfg
+
+	if devices, err := store.Devices().List(); err == nil {
+		for _, d := range devices {
+			if !d.Revoked() {
+				r.ActiveDevices++
+			}
+		}
+	}
+
+	r.Service.Running, r.Service.State = svc.Status(ctx)
+	if r.Service.Running {
+		r.Service.State = "running"
+	}
+
+	client := control.NewClient(configDir)
+	var health agent.AgentHealth
+	if err := client.Get(ctx, "/health", &health); err == nil {
+		r.Agent = &health
+	} else {
+		r.AgentErr = err
+	}
+	var offenders []gateway.Offender
+	if err := client.Get(ctx, "/lockouts", &offenders); err == nil {
+		r.Lockouts = offenders
+	}
+	if st, ok := agent.ReadStatus(configDir); ok {
+		r.Status = &st
 	}
 
+	r.Assess()
+	return r
+}
+
+func printStatus(r status.Report) {
+	cfg := r.Config
 	fmt.Println("Config:")
 	fmt.Println("  mode:", cfg.Mode)
 	fmt.Println("  gatewayPort:", cfg.GatewayPort)
 	fmt.Println("  openCodePort:", cfg.OpenCodePort)
 	fmt.Println("  openCodePath:", cfg.OpenCodePath)
 	fmt.Println("  defaultDirectory:", cfg.DefaultDirectory)
+	fmt.Println("  tls:", cfg.TLS)
+
+	fmt.Println()
+	fmt.Println("Devices:", r.ActiveDevices, "active")
 
-	running, state := launchctlPrint(context.Background())
 	fmt.Println()
-	fmt.Println("LaunchAgent:", ocmobile.LaunchAgentLabel)
-	if running {
-		fmt.Println("  state: running")
+	fmt.Println(r.Service.Kind+":", r.Service.Label)
+	fmt.Println("  state:", r.Service.State)
+
+	if health := r.Agent; health != nil {
+		fmt.Println()
+		fmt.Println("Agent:")
+		fmt.Println("  version:", health.Version)
+		fmt.Println("  uptime:", (time.Duration(health.UptimeMs) * time.Millisecond).Round(time.Second))
+		fmt.Println("  gateway:", health.GatewayURL)
+		fmt.Println("  opencode ready:", health.Upstream.Ready)
 	} else {
-		fmt.Println("  state:", state)
+		fmt.Println()
+		fmt.Println("Agent: not reachable (" + r.AgentErr.Error() + ")")
+	}
+
+	if len(r.Lockouts) > 0 {
+		fmt.Println()
+		fmt.Println("Lockouts:")
+		printOffenders(r.Lockouts)
 	}
 
-	if status, ok := agent.ReadStatus(configDir); ok {
+	if status := r.Status; status != nil {
 		fmt.Println()
 		fmt.Println("Last status:")
 		fmt.Println("  updatedAt:", time.UnixMilli(status.UpdatedAtMs).Format(time.RFC3339))
@@ -355,12 +542,469 @@ func cmdStatus(args []string) int {
 		} else {
 			fmt.Println("  lastError: (none)")
 		}
+		if oc := status.OpenCode; oc.State != "" {
+			line := fmt.Sprintf("  opencode: %s (ready: %t", oc.State, oc.Ready)
+			if oc.LastProbeAtMs != 0 {
+				line += fmt.Sprintf(", probe %dms at %s", oc.ProbeLatencyMs, formatMillis(oc.LastProbeAtMs))
+			}
+			fmt.Println(line + ")")
+			if oc.PID != 0 {
+				fmt.Printf("  opencode pid: %d (started %s)\n", oc.PID, formatMillis(oc.StartedAtMs))
+			}
+			line = fmt.Sprintf("  opencode restarts: %d", oc.Restarts)
+			if oc.LastExitCode != nil {
+				line += fmt.Sprintf(" (last exit code %d)", *oc.LastExitCode)
+			}
+			fmt.Println(line)
+		}
+		if gw := status.Gateway; len(gw.ListenAddrs) > 0 {
+			fmt.Println("  listening:", strings.Join(gw.ListenAddrs, ", "))
+			fmt.Println("  pairing base URL:", gw.PairingBaseURL)
+			fmt.Println("  event clients:", gw.Clients)
+		}
+		if ts := status.Tailscale; ts != nil {
+			line := fmt.Sprintf("  tailscale: logged in: %t, serve: %t", ts.LoggedIn, ts.Serve)
+			if ts.DNSName != "" {
+				line += ", " + ts.DNSName
+			}
+			if ts.Error != "" {
+				line += " (" + ts.Error + ")"
+			}
+			fmt.Println(line)
+		}
+		if n := len(status.RecentErrors); n > 0 {
+			fmt.Println("  recent errors:")
+			for _, e := range status.RecentErrors[max(n-5, 0):] {
+				fmt.Printf("    %s  %s\n", formatMillis(e.AtMs), e.Message)
+			}
+		}
+	}
+
+	fmt.Println()
+	fmt.Println("State:", r.State)
+	for _, p := range r.Problems {
+		fmt.Println("  " + p)
+	}
+}
+
+func cmdDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	configDir, err := ocmobile.ConfigDir(*configDirFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	checks := runDoctor(ctx, configDir)
+	for _, c := range checks {
+		fmt.Printf("[%s] %s: %s\n", strings.ToUpper(string(c.Result)), c.Name, c.Detail)
+		if c.Fix != "" {
+			fmt.Println("       fix: " + c.Fix)
+		}
+	}
+
+	counts := map[doctor.Result]int{}
+	for _, c := range checks {
+		counts[c.Result]++
+	}
+	fmt.Println()
+	fmt.Printf("%d passed, %d warnings, %d failed\n", counts[doctor.Pass], counts[doctor.Warn], counts[doctor.Fail])
+	if doctor.Worst(checks) == doctor.Fail {
+		return 1
 	}
 	return 0
 }
 
+func runDoctor(ctx context.Context, configDir string) []doctor.Check {
+	checks := []doctor.Check{doctor.Permissions("config dir", configDir, 0o700)}
+
+	store := config.Store{BaseDir: configDir}
+	cfg, err := store.Load()
+	if err != nil {
+		return append(checks, doctor.Check{Name: "config", Result: doctor.Fail, Detail: err.Error(), Fix: "run `oc-pocket setup`"})
+	}
+	registry := store.Devices()
+	checks = append(checks,
+		doctor.Permissions("config file", filepath.Join(configDir, "config.json"), 0o600),
+		doctor.Permissions("device tokens", registry.Path(), 0o600),
+	)
+	if cfg.TLS {
+		checks = append(checks, doctor.Permissions("TLS CA key", filepath.Join(tlsutil.Dir(configDir), "ca-key.pem"), 0o600))
+	}
+
+	checks = append(checks, doctor.OpenCode(ctx, cfg.OpenCodePath))
+
+	if runtime.GOOS == "darwin" || runtime.GOOS == "linux" {
+		checks = append(checks, serviceCheck(configDir))
+	}
+
+	var health agent.AgentHealth
+	agentErr := control.NewClient(configDir).Get(ctx, "/health", &health)
+	agentRunning := agentErr == nil
+	if agentRunning {
+		checks = append(checks, doctor.Check{Name: "agent", Result: doctor.Pass, Detail: "running " + health.Version + ", gateway at " + health.GatewayURL})
+	} else {
+		checks = append(checks, doctor.Check{Name: "agent", Result: doctor.Fail, Detail: agentErr.Error(), Fix: "run `oc-pocket restart` (or `oc-pocket setup` if it was never installed)"})
+	}
+	status, _ := agent.ReadStatus(configDir)
+
+	gatewayAddr := fmt.Sprintf("127.0.0.1:%d", cfg.GatewayPort)
+	if cfg.Mode == config.ModeLAN {
+		gatewayAddr = fmt.Sprintf(":%d", cfg.GatewayPort)
+	}
+	if agentRunning && len(status.Gateway.ListenAddrs) > 0 {
+		gatewayAddr = status.Gateway.ListenAddrs[0]
+	}
+	checks = append(checks,
+		doctor.Port("gateway port", gatewayAddr, agentRunning),
+		doctor.Port("opencode port", fmt.Sprintf("127.0.0.1:%d", cfg.OpenCodePort), agentRunning),
+	)
+	if addr := agent.MetricsAddr(cfg); addr != "" {
+		checks = append(checks, doctor.Port("metrics port", addr, agentRunning))
+	}
+
+	if cfg.Mode == config.ModeTailscale {
+		checks = append(checks, doctor.Tailscale(ctx, tailscale.Client{Runner: executil.NewRunner()}, cfg.GatewayPort)...)
+	}
+
+	// The agent records the URL it would pair with. Without it, only modes that do not depend on
+	// Tailscale Serve can be worked out without changing anything.
+	baseURL := ""
+	switch {
+	case agentRunning && status.Gateway.PairingBaseURL != "":
+		baseURL = status.Gateway.PairingBaseURL
+	case cfg.Mode != config.ModeTailscale:
+		baseURL, _, _ = computePairingBaseURL(ctx, cfg.Mode, cfg.GatewayPort, cfg.TLS)
+	}
+	if baseURL == "" {
+		checks = append(checks, doctor.Check{Name: "pairing base URL", Result: doctor.Warn, Detail: "unknown until the agent is running"})
+		return checks
+	}
+	checks = append(checks, doctor.BaseURL(baseURL))
+
+	if !agentRunning {
+		return checks
+	}
+	device, ok := doctorDevice(registry)
+	if !ok {
+		return append(checks, doctor.Check{Name: "gateway round-trip", Result: doctor.Warn, Detail: "no active device to authenticate as", Fix: "run `oc-pocket devices add <name>`"})
+	}
+	client := &http.Client{}
+	if cfg.TLS {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err := tlsutil.AppendCA(pool, tlsutil.Dir(configDir)); err == nil {
+			client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		}
+	}
+	return append(checks, doctor.RoundTrip(ctx, client, baseURL, device.Token))
+}
+
+func serviceCheck(configDir string) doctor.Check {
+	svc := currentService()
+	name := svc.Kind() + " definition"
+	defPath, err := svc.DefinitionPath()
+	if err != nil {
+		return doctor.Check{Name: name, Result: doctor.Warn, Detail: err.Error()}
+	}
+	binPath, _, err := agentBinaryPath()
+	if err != nil {
+		return doctor.Check{Name: name, Result: doctor.Warn, Detail: err.Error()}
+	}
+	want, err := svc.Render(binPath, configDir)
+	if err != nil {
+		return doctor.Check{Name: name, Result: doctor.Warn, Detail: err.Error()}
+	}
+	return doctor.ServiceDefinition(name, defPath, want)
+}
+
+// doctorDevice picks the device whose token `doctor` uses: the one paired by setup if it is
+// still active, otherwise the first active one.
+func doctorDevice(registry config.DeviceRegistry) (config.Device, bool) {
+	devices, err := registry.List()
+	if err != nil {
+		return config.Device{}, false
+	}
+	var found *config.Device
+	for i, d := range devices {
+		if d.Revoked() {
+			continue
+		}
+		if d.Name == config.DefaultDevice {
+			return d, true
+		}
+		if found == nil {
+			found = &devices[i]
+		}
+	}
+	if found == nil {
+		return config.Device{}, false
+	}
+	return *found, true
+}
+
+func cmdLogs(args []string) int {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	followFlag := fs.Bool("follow", false, "keep printing new lines as they are written")
+	sourceFlag := fs.String("source", "", "only show lines from agent|opencode|gateway")
+	sinceFlag := fs.Duration("since", 0, "only show lines from this long ago, e.g. 10m")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	switch *sourceFlag {
+	case "", "agent", "opencode", "gateway":
+	default:
+		fmt.Fprintln(os.Stderr, "Invalid --source (expected agent|opencode|gateway):", *sourceFlag)
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	configDir, err := ocmobile.ConfigDir(*configDirFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	// Agent and gateway lines share agent.log; OpenCode has its own file.
+	var files []string
+	if *sourceFlag != "opencode" {
+		files = append(files, agent.AgentLogFile)
+	}
+	if *sourceFlag == "" || *sourceFlag == "opencode" {
+		files = append(files, agent.OpenCodeLogFile)
+	}
+	var streams []*logStream
+	defer func() {
+		for _, s := range streams {
+			s.cursor.Close()
+		}
+	}()
+	for _, name := range files {
+		cursor, err := logfile.OpenCursor(filepath.Join(agent.LogsDir(configDir), name))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		streams = append(streams, &logStream{cursor: cursor})
+	}
+
+	// Tokens are redacted even if they were revoked since the line was written.
+	var secrets []string
+	if devices, err := (config.Store{BaseDir: configDir}).Devices().List(); err == nil {
+		for _, d := range devices {
+			secrets = append(secrets, d.Token)
+		}
+	}
+	redactor := logfile.NewRedactor(secrets)
+
+	var since time.Time
+	if *sinceFlag > 0 {
+		since = time.Now().Add(-*sinceFlag)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer func() { _ = out.Flush() }()
+	for {
+		for {
+			s, err := nextLogLine(streams)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				return 1
+			}
+			if s == nil {
+				break
+			}
+			line := s.take()
+			if !since.IsZero() && s.last.Before(since) {
+				continue
+			}
+			if *sourceFlag != "" && line.Source != *sourceFlag && !(line.Source == "" && *sourceFlag == "agent") {
+				continue
+			}
+			_, _ = out.WriteString(redactor.Redact(line.raw) + "\n")
+		}
+		if !*followFlag {
+			return 0
+		}
+		_ = out.Flush()
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// logStream is one log file being read by `oc-pocket logs`, with its next line read ahead so
+// streams can be merged by time.
+type logStream struct {
+	cursor *logfile.Cursor
+	head   *logLine
+	// last is the time of the most recent timestamped line; lines without one inherit it.
+	last time.Time
+}
+
+type logLine struct {
+	logfile.Line
+	raw string
+}
+
+func (s *logStream) take() logLine {
+	line := *s.head
+	s.head = nil
+	if !line.Time.IsZero() {
+		s.last = line.Time
+	}
+	return line
+}
+
+// nextLogLine returns the stream whose next line is the oldest, or nil if every stream has
+// been read to the end.
+func nextLogLine(streams []*logStream) (*logStream, error) {
+	var next *logStream
+	for _, s := range streams {
+		if s.head == nil {
+			raw, ok, err := s.cursor.Next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			s.head = &logLine{Line: logfile.ParseLine(raw), raw: raw}
+		}
+		if next == nil || s.head.at(s.last).Before(next.head.at(next.last)) {
+			next = s
+		}
+	}
+	return next, nil
+}
+
+func (l logLine) at(last time.Time) time.Time {
+	if l.Time.IsZero() {
+		return last
+	}
+	return l.Time
+}
+
+func cmdAudit(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	sessionFlag := fs.String("session", "", "only show actions on this session")
+	sinceFlag := fs.String("since", "", "only show actions from this long ago (e.g. 24h) or since this time (RFC 3339 or YYYY-MM-DD)")
+	untilFlag := fs.String("until", "", "only show actions before this time (RFC 3339 or YYYY-MM-DD)")
+	jsonFlag := fs.Bool("json", false, "print matching entries as JSON lines")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	now := time.Now()
+	filter := audit.Filter{Session: *sessionFlag}
+	var err error
+	if filter.Since, err = parseTimeFlag(*sinceFlag, now); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid --since:", err.Error())
+		return 2
+	}
+	if filter.Until, err = parseTimeFlag(*untilFlag, now); err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid --until:", err.Error())
+		return 2
+	}
+
+	configDir, err := ocmobile.ConfigDir(*configDirFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	entries, err := audit.Read(audit.Path(configDir))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		if !filter.Match(e) {
+			continue
+		}
+		if *jsonFlag {
+			_ = enc.Encode(e)
+			continue
+		}
+		result := strconv.Itoa(e.Status)
+		if e.Error != "" {
+			msg := strings.Join(strings.Fields(e.Error), " ")
+			if len(msg) > 60 {
+				msg = msg[:60] + "..."
+			}
+			result += " " + msg
+		}
+		body := fmt.Sprintf("body sha256:%.12s (%d bytes)", e.BodySHA256, e.BodyBytes)
+		if e.BodySHA256 == "" {
+			body = "body not forwarded"
+		}
+		fmt.Printf("%s  %-10s %-16s %-24s %s  %s  %s\n",
+			time.UnixMilli(e.AtMs).Format("2006-01-02 15:04:05"), e.Device, e.Action, e.Session, e.Directory, body, result)
+	}
+
+	// The whole log is verified, not just the entries shown.
+	if err := audit.Verify(entries); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: "+err.Error())
+		return 1
+	}
+	if len(entries) > 0 && !*jsonFlag {
+		last := entries[len(entries)-1]
+		fmt.Fprintf(os.Stderr, "Chain verified: %d entries, head %s\n", last.Seq, last.Hash)
+	}
+	return 0
+}
+
+// parseTimeFlag parses a duration before now (e.g. 24h), an RFC 3339 time or a local date.
+// An empty value is the zero time.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a duration, RFC 3339 time or YYYY-MM-DD date", value)
+}
+
 func cmdRestart(args []string) int {
 	fs := flag.NewFlagSet("restart", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	opencodeFlag := fs.Bool("opencode", false, "restart only OpenCode, keeping the agent and gateway running")
 	if err := fs.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return 0
@@ -372,17 +1016,37 @@ func cmdRestart(args []string) int {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	if err := launchctlKickstart(ctx); err != nil {
+	if *opencodeFlag {
+		configDir, err := ocmobile.ConfigDir(*configDirFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		var result agent.RestartResult
+		if err := control.NewClient(configDir).Do(ctx, http.MethodPost, "/opencode/restart", &result); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		if result.Rearmed {
+			fmt.Println("OpenCode had stopped after repeated crashes; re-armed and restarting it")
+		} else {
+			fmt.Println("Restarting OpenCode")
+		}
+		return 0
+	}
+
+	svc := currentService()
+	if err := svc.Restart(ctx); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return 1
 	}
-	fmt.Println("Restarted:", ocmobile.LaunchAgentLabel)
+	fmt.Println("Restarted:", svc.Label())
 	return 0
 }
 
 func cmdToken(args []string) int {
 	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" {
-		fmt.Println("Usage: oc-pocket token rotate")
+		fmt.Println("Usage: oc-pocket token rotate [--device <name>]")
 		return 0
 	}
 	switch args[0] {
@@ -397,6 +1061,7 @@ func cmdToken(args []string) int {
 func cmdTokenRotate(args []string) int {
 	fs := flag.NewFlagSet("token rotate", flag.ContinueOnError)
 	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	deviceFlag := fs.String("device", config.DefaultDevice, "device whose token to rotate")
 	if err := fs.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			return 0
@@ -415,7 +1080,7 @@ func cmdTokenRotate(args []string) int {
 	}
 
 	store := config.Store{BaseDir: configDir}
-	cfg, _, err := store.Load()
+	cfg, err := store.Load()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Not set up yet. Run: oc-pocket setup")
 		return 1
@@ -426,28 +1091,317 @@ func cmdTokenRotate(args []string) int {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return 1
 	}
-	if err := store.Save(cfg, token); err != nil {
+	registry := store.Devices()
+	if _, err := registry.MigrateLegacyToken(time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	// The agent re-reads the device registry on change, so no restart is needed.
+	if err := registry.RotateToken(*deviceFlag, token); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	device, err := registry.Get(*deviceFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	fmt.Println("New pairing string for device " + device.Name + ":")
+	return printPairing(ctx, cfg, configDir, device)
+}
+
+func cmdDevices(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" {
+		fmt.Println("Usage: oc-pocket devices list|add <name>|revoke <name>")
+		return 0
+	}
+	switch args[0] {
+	case "list":
+		return cmdDevicesList(args[1:])
+	case "add":
+		return cmdDevicesAdd(args[1:])
+	case "revoke":
+		return cmdDevicesRevoke(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown devices subcommand:", args[0])
+		return 2
+	}
+}
+
+func cmdDevicesList(args []string) int {
+	fs := flag.NewFlagSet("devices list", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	configDir, err := ocmobile.ConfigDir(*configDirFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	registry := config.DeviceRegistry{BaseDir: configDir}
+	if _, err := registry.MigrateLegacyToken(time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	devices, err := registry.List()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if len(devices) == 0 {
+		fmt.Println("No paired devices. Run: oc-pocket devices add <name>")
+		return 0
+	}
+
+	for _, d := range devices {
+		fmt.Println(d.Name + ":")
+		fmt.Println("  scope:", d.EffectiveScope())
+		fmt.Println("  created:", formatMillis(d.CreatedAtMs))
+		fmt.Println("  lastSeen:", formatMillis(d.LastSeenAtMs))
+		if d.Revoked() {
+			fmt.Println("  revoked:", formatMillis(d.RevokedAtMs))
+		}
+	}
+	return 0
+}
+
+func cmdDevicesAdd(args []string) int {
+	fs := flag.NewFlagSet("devices add", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	scopeFlag := fs.String("scope", string(config.ScopeChat), "read|chat|admin")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: oc-pocket devices add [--config-dir <dir>] [--scope read|chat|admin] <name>")
+		return 2
+	}
+	name := fs.Arg(0)
+	scope, err := config.ParseScope(*scopeFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	configDir, err := ocmobile.ConfigDir(*configDirFlag)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return 1
 	}
 
-	if err := launchctlKickstart(ctx); err != nil {
-		fmt.Fprintln(os.Stderr, "Warning: could not restart oc-pocket agent. Run `oc-pocket restart` before using the new pairing string.")
-		fmt.Fprintln(os.Stderr, "Warning:", err.Error())
+	store := config.Store{BaseDir: configDir}
+	cfg, err := store.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Not set up yet. Run: oc-pocket setup")
+		return 1
+	}
+
+	registry := store.Devices()
+	if _, err := registry.MigrateLegacyToken(time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
 	}
+	d, err := addDevice(registry, name, scope)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		if errors.Is(err, config.ErrDeviceExists) {
+			fmt.Fprintln(os.Stderr, "Use `oc-pocket token rotate --device "+name+"` to issue a new token for it.")
+		}
+		return 1
+	}
+
+	fmt.Println("Pairing string for device " + d.Name + " (scope: " + string(d.EffectiveScope()) + "):")
+	return printPairing(ctx, cfg, configDir, d)
+}
 
-	baseURL, _, _ := computePairingBaseURL(ctx, cfg.Mode, cfg.GatewayPort)
+func cmdDevicesRevoke(args []string) int {
+	fs := flag.NewFlagSet("devices revoke", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: oc-pocket devices revoke [--config-dir <dir>] <name>")
+		return 2
+	}
+	name := fs.Arg(0)
+
+	configDir, err := ocmobile.ConfigDir(*configDirFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	registry := config.DeviceRegistry{BaseDir: configDir}
+	if _, err := registry.MigrateLegacyToken(time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if err := registry.Revoke(name, time.Now()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Println("Revoked:", name)
+	return 0
+}
+
+func cmdLockouts(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" {
+		fmt.Println("Usage: oc-pocket lockouts list|clear <ip>|clear --all")
+		return 0
+	}
+	switch args[0] {
+	case "list":
+		return cmdLockoutsList(args[1:])
+	case "clear":
+		return cmdLockoutsClear(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown lockouts subcommand:", args[0])
+		return 2
+	}
+}
+
+func cmdLockoutsList(args []string) int {
+	fs := flag.NewFlagSet("lockouts list", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	configDir, err := ocmobile.ConfigDir(*configDirFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	var offenders []gateway.Offender
+	if err := control.NewClient(configDir).Get(context.Background(), "/lockouts", &offenders); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if len(offenders) == 0 {
+		fmt.Println("No failed authentication attempts recorded.")
+		return 0
+	}
+	printOffenders(offenders)
+	return 0
+}
+
+func cmdLockoutsClear(args []string) int {
+	fs := flag.NewFlagSet("lockouts clear", flag.ContinueOnError)
+	configDirFlag := fs.String("config-dir", "", "override config dir (advanced)")
+	allFlag := fs.Bool("all", false, "clear every lockout")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	if *allFlag == (fs.NArg() == 1) || fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: oc-pocket lockouts clear [--config-dir <dir>] <ip>|--all")
+		return 2
+	}
+
+	configDir, err := ocmobile.ConfigDir(*configDirFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	path := "/lockouts?all=1"
+	if !*allFlag {
+		path = "/lockouts?ip=" + url.QueryEscape(fs.Arg(0))
+	}
+	var result agent.ClearLockoutsResult
+	if err := control.NewClient(configDir).Do(context.Background(), http.MethodDelete, path, &result); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Println("Cleared lockouts:", result.Cleared)
+	return 0
+}
+
+func printOffenders(offenders []gateway.Offender) {
+	for _, o := range offenders {
+		line := fmt.Sprintf("  %s: %d failed attempts, last at %s", o.IP, o.Failures, formatMillis(o.LastFailureAtMs))
+		if o.BannedUntilMs != 0 {
+			line += ", banned until " + formatMillis(o.BannedUntilMs)
+		}
+		fmt.Println(line)
+	}
+}
+
+// durationSetting converts a duration flag to the config's seconds convention: 0 keeps the
+// default, a negative value disables the feature.
+func durationSetting(d time.Duration, def time.Duration) int {
+	switch {
+	case d == 0:
+		return -1
+	case d == def:
+		return 0
+	default:
+		return max(1, int(d.Seconds()))
+	}
+}
+
+// intSetting is durationSetting for plain numbers.
+func intSetting(v int, def int) int {
+	switch {
+	case v <= 0:
+		return -1
+	case v == def:
+		return 0
+	default:
+		return v
+	}
+}
+
+func addDevice(registry config.DeviceRegistry, name string, scope config.Scope) (config.Device, error) {
+	token, err := pairing.GenerateToken()
+	if err != nil {
+		return config.Device{}, err
+	}
+	return registry.Add(name, token, scope, time.Now())
+}
+
+func printPairing(ctx context.Context, cfg config.Config, configDir string, device config.Device) int {
+	baseURL, _, _ := computePairingBaseURL(ctx, cfg.Mode, cfg.GatewayPort, cfg.TLS)
 	payload, err := pairing.Encode(pairing.Payload{
-		Version: 1,
-		BaseURL: baseURL,
-		Token:   token,
-		Name:    ocmobile.DefaultDeviceName(),
+		Version:    1,
+		BaseURL:    baseURL,
+		Token:      device.Token,
+		Name:       ocmobile.DefaultDeviceName(),
+		Scope:      string(device.EffectiveScope()),
+		CertSHA256: certFingerprint(cfg, configDir, baseURL),
 	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		return 1
 	}
-	fmt.Println("New pairing string:")
 	fmt.Println("  " + payload)
 	fmt.Println()
 	fmt.Println("QR code:")
@@ -455,6 +1409,30 @@ func cmdTokenRotate(args []string) int {
 	return 0
 }
 
+// certFingerprint returns the CA fingerprint the app should pin, or "" when the base URL is not
+// served by the gateway's own certificate (plain HTTP, or HTTPS terminated by Tailscale Serve).
+func certFingerprint(cfg config.Config, configDir string, baseURL string) string {
+	if !cfg.TLS || !strings.HasPrefix(baseURL, "https://") {
+		return ""
+	}
+	if u, err := url.Parse(baseURL); err != nil || net.ParseIP(u.Hostname()) == nil {
+		return ""
+	}
+	fp, err := tlsutil.CAFingerprint(tlsutil.Dir(configDir))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: could not read the gateway certificate: "+err.Error())
+		return ""
+	}
+	return fp
+}
+
+func formatMillis(ms int64) string {
+	if ms == 0 {
+		return "never"
+	}
+	return time.UnixMilli(ms).Format(time.RFC3339)
+}
+
 func resolveMode(mode string) (config.Mode, error) {
 	mode = strings.TrimSpace(strings.ToLower(mode))
 	if mode == "" {
@@ -558,16 +1536,22 @@ func buildRepoBinary(ctx context.Context, repoRoot string) error {
 	return nil
 }
 
-func computePairingBaseURL(ctx context.Context, mode config.Mode, gatewayPort int) (baseURL string, extraURLs []string, warn string) {
+// computePairingBaseURL picks the URL the phone should use. With useTLS, the agent serves HTTPS
+// whenever it binds to a non-loopback address, so those URLs use https:// as well.
+func computePairingBaseURL(ctx context.Context, mode config.Mode, gatewayPort int, useTLS bool) (baseURL string, extraURLs []string, warn string) {
+	directScheme := "http"
+	if useTLS {
+		directScheme = "https"
+	}
 	switch mode {
 	case config.ModeLAN:
 		ips := netutil.LocalIPv4s()
 		urls := make([]string, 0, len(ips))
 		for _, ip := range ips {
-			urls = append(urls, fmt.Sprintf("http://%s:%d", ip, gatewayPort))
+			urls = append(urls, fmt.Sprintf("%s://%s:%d", directScheme, ip, gatewayPort))
 		}
 		if len(urls) == 0 {
-			return fmt.Sprintf("http://127.0.0.1:%d", gatewayPort), nil, "Warning: could not detect a LAN IP; falling back to localhost."
+			return fmt.Sprintf("%s://127.0.0.1:%d", directScheme, gatewayPort), nil, "Warning: could not detect a LAN IP; falling back to localhost."
 		}
 		return urls[0], urls[1:], ""
 
@@ -580,17 +1564,20 @@ func computePairingBaseURL(ctx context.Context, mode config.Mode, gatewayPort in
 			// locally, use it so iPhone pairing doesn't silently become localhost-only.
 			if errors.Is(err, tailscale.ErrStatusUnreadable) {
 				if ips := netutil.CGNATIPv4s(); len(ips) > 0 {
-				base := fmt.Sprintf("http://%s:%d", ips[0], gatewayPort)
-				warn = "Warning: Tailscale status could not be read; falling back to detected tailnet IP. " + err.Error()
-				warn = warn + " " + fmt.Sprintf(
-					"Warning: iOS may block this HTTP URL due to App Transport Security. Fix: enable Tailscale Serve to get an HTTPS Base URL "+
-						"(try `tailscale serve --bg %d` on newer versions; otherwise run `tailscale serve --help` and serve localhost:%d), "+
-						"then re-run `oc-pocket setup`, or choose option 2 (Local Network).",
-					gatewayPort,
-					gatewayPort,
-				)
-				return base, nil, warn
-			}
+					base := fmt.Sprintf("%s://%s:%d", directScheme, ips[0], gatewayPort)
+					warn = "Warning: Tailscale status could not be read; falling back to detected tailnet IP. " + err.Error()
+					if useTLS {
+						return base, nil, warn
+					}
+					warn = warn + " " + fmt.Sprintf(
+						"Warning: iOS may block this HTTP URL due to App Transport Security. Fix: enable Tailscale Serve to get an HTTPS Base URL "+
+							"(try `tailscale serve --bg %d` on newer versions; otherwise run `tailscale serve --help` and serve localhost:%d), "+
+							"then re-run `oc-pocket setup`, or re-run `oc-pocket setup --tls` to serve HTTPS with a pinned certificate.",
+						gatewayPort,
+						gatewayPort,
+					)
+					return base, nil, warn
+				}
 			}
 			return fmt.Sprintf("http://127.0.0.1:%d", gatewayPort), nil, "Warning: Tailscale not ready; falling back to localhost. " + err.Error()
 		}
@@ -610,22 +1597,26 @@ func computePairingBaseURL(ctx context.Context, mode config.Mode, gatewayPort in
 			} else {
 				warn = "Warning: " + d.Warn
 			}
-			}
-			if strings.HasPrefix(d.BaseURL, "http://") {
-				// iOS blocks non-HTTPS loads by default (ATS). When Tailscale Serve is not available, we fall back
-				// to the tailnet IPv4 which uses HTTP; this may fail on iPhone unless using a Debug build that
-				// allows arbitrary loads, or unless you choose LAN mode.
-				suffix := fmt.Sprintf(
-					"Warning: iOS may block this HTTP URL due to App Transport Security. Fix: enable Tailscale Serve to get an HTTPS Base URL "+
-						"(try `tailscale serve --bg %d` on newer versions; otherwise run `tailscale serve --help` and serve localhost:%d), "+
-						"then re-run `oc-pocket setup`, or choose option 2 (Local Network).",
-					gatewayPort,
-					gatewayPort,
-				)
-				if warn != "" {
-					warn = warn + " " + suffix
-				} else {
-					warn = suffix
+		}
+		if useTLS && strings.HasPrefix(d.BaseURL, "http://") {
+			// Tailscale-IP fallback binds directly to the tailnet IP, where the agent serves HTTPS itself.
+			d.BaseURL = "https://" + strings.TrimPrefix(d.BaseURL, "http://")
+		}
+		if strings.HasPrefix(d.BaseURL, "http://") {
+			// iOS blocks non-HTTPS loads by default (ATS). When Tailscale Serve is not available, we fall back
+			// to the tailnet IPv4 which uses HTTP; this may fail on iPhone unless using a Debug build that
+			// allows arbitrary loads, or unless you choose LAN mode.
+			suffix := fmt.Sprintf(
+				"Warning: iOS may block this HTTP URL due to App Transport Security. Fix: enable Tailscale Serve to get an HTTPS Base URL "+
+					"(try `tailscale serve --bg %d` on newer versions; otherwise run `tailscale serve --help` and serve localhost:%d), "+
+					"then re-run `oc-pocket setup`, or re-run `oc-pocket setup --tls` to serve HTTPS with a pinned certificate.",
+				gatewayPort,
+				gatewayPort,
+			)
+			if warn != "" {
+				warn = warn + " " + suffix
+			} else {
+				warn = suffix
 			}
 		}
 		if d.BaseURL == "" {
@@ -689,46 +1680,6 @@ func assertDir(path string) error {
 	return nil
 }
 
-func launchctlBootstrap(ctx context.Context, plistPath string) error {
-	uid := os.Getuid()
-	domain := "gui/" + strconv.Itoa(uid)
-	job := domain + "/" + ocmobile.LaunchAgentLabel
-
-	_ = exec.CommandContext(ctx, "launchctl", "bootout", job).Run()
-
-	if out, err := exec.CommandContext(ctx, "launchctl", "bootstrap", domain, plistPath).CombinedOutput(); err != nil {
-		return fmt.Errorf("launchctl bootstrap failed: %w: %s", err, strings.TrimSpace(string(out)))
-	}
-	if out, err := exec.CommandContext(ctx, "launchctl", "kickstart", "-k", job).CombinedOutput(); err != nil {
-		return fmt.Errorf("launchctl kickstart failed: %w: %s", err, strings.TrimSpace(string(out)))
-	}
-	return nil
-}
-
-func launchctlKickstart(ctx context.Context) error {
-	uid := os.Getuid()
-	job := "gui/" + strconv.Itoa(uid) + "/" + ocmobile.LaunchAgentLabel
-	out, err := exec.CommandContext(ctx, "launchctl", "kickstart", "-k", job).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("launchctl kickstart failed: %w: %s", err, strings.TrimSpace(string(out)))
-	}
-	return nil
-}
-
-func launchctlPrint(ctx context.Context) (bool, string) {
-	uid := os.Getuid()
-	job := "gui/" + strconv.Itoa(uid) + "/" + ocmobile.LaunchAgentLabel
-	out, err := exec.CommandContext(ctx, "launchctl", "print", job).CombinedOutput()
-	if err != nil {
-		return false, strings.TrimSpace(string(out))
-	}
-	s := string(out)
-	if strings.Contains(s, "state = running") || strings.Contains(s, "state = waiting") {
-		return true, "ok"
-	}
-	return false, "not running"
-}
-
 func cmdUninstall(args []string) int {
 	fs := flag.NewFlagSet("uninstall", flag.ContinueOnError)
 	purgeFlag := fs.Bool("purge", false, "also delete config directory (token, logs)")
@@ -744,14 +1695,8 @@ func cmdUninstall(args []string) int {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	uid := os.Getuid()
-	job := "gui/" + strconv.Itoa(uid) + "/" + ocmobile.LaunchAgentLabel
-	_ = exec.CommandContext(ctx, "launchctl", "bootout", job).Run()
-
-	plistPath, err := ocmobile.LaunchAgentPlistPath()
-	if err == nil {
-		_ = os.Remove(plistPath)
-	}
+	svc := currentService()
+	svc.Remove(ctx)
 
 	if *purgeFlag {
 		configDir, err := ocmobile.ConfigDir(*configDirFlag)
@@ -762,7 +1707,7 @@ func cmdUninstall(args []string) int {
 		_ = os.RemoveAll(configDir)
 	}
 
-	fmt.Println("Uninstalled:", ocmobile.LaunchAgentLabel)
+	fmt.Println("Uninstalled:", svc.Label())
 	if *purgeFlag {
 		fmt.Println("Purged config directory.")
 	}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/launchd"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/ocmobile"
+	"github.com/ratulsarna/opencode-pocket/companion/oc-pocket/internal/systemd"
+)
+
+// agentService is the per-user service that keeps `oc-pocket agent` running: a LaunchAgent on
+// macOS and a systemd user unit on Linux.
+type agentService interface {
+	// Manager is "launchd" or "systemd"; Label is the service's name there.
+	Manager() string
+	Label() string
+	// Kind names the service in messages, e.g. "LaunchAgent".
+	Kind() string
+	// DefinitionPath is where the plist or unit file is installed.
+	DefinitionPath() (string, error)
+	Render(binPath string, configDir string) ([]byte, error)
+	// Install loads the definition at path and (re)starts the service.
+	Install(ctx context.Context, path string) error
+	Restart(ctx context.Context) error
+	Status(ctx context.Context) (running bool, state string)
+	// Remove stops the service and deletes its definition.
+	Remove(ctx context.Context)
+}
+
+func currentService() agentService {
+	if runtime.GOOS == "linux" {
+		return systemdService{}
+	}
+	return launchdService{}
+}
+
+// serviceStdio returns the files that catch the service's own stdout and stderr, i.e. output
+// from before the agent opens its logs.
+func serviceStdio(configDir string) (stdout string, stderr string) {
+	return filepath.Join(configDir, "agent.stdout.log"), filepath.Join(configDir, "agent.stderr.log")
+}
+
+type launchdService struct{}
+
+func (launchdService) Manager() string { return "launchd" }
+func (launchdService) Label() string   { return ocmobile.LaunchAgentLabel }
+func (launchdService) Kind() string    { return "LaunchAgent" }
+
+func (launchdService) DefinitionPath() (string, error) {
+	return ocmobile.LaunchAgentPlistPath()
+}
+
+func (launchdService) Render(binPath string, configDir string) ([]byte, error) {
+	stdout, stderr := serviceStdio(configDir)
+	return launchd.RenderPlist(launchd.PlistOptions{
+		Label:       ocmobile.LaunchAgentLabel,
+		Program:     binPath,
+		ProgramArgs: []string{"agent", "--config-dir", configDir},
+		RunAtLoad:   true,
+		KeepAlive:   true,
+		StdoutPath:  stdout,
+		StderrPath:  stderr,
+	})
+}
+
+func (launchdService) Install(ctx context.Context, plistPath string) error {
+	uid := os.Getuid()
+	domain := "gui/" + strconv.Itoa(uid)
+	job := domain + "/" + ocmobile.LaunchAgentLabel
+
+	_ = exec.CommandContext(ctx, "launchctl", "bootout", job).Run()
+
+	if out, err := exec.CommandContext(ctx, "launchctl", "bootstrap", domain, plistPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl bootstrap failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.CommandContext(ctx, "launchctl", "kickstart", "-k", job).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl kickstart failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (launchdService) Restart(ctx context.Context) error {
+	uid := os.Getuid()
+	job := "gui/" + strconv.Itoa(uid) + "/" + ocmobile.LaunchAgentLabel
+	out, err := exec.CommandContext(ctx, "launchctl", "kickstart", "-k", job).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl kickstart failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (launchdService) Status(ctx context.Context) (bool, string) {
+	uid := os.Getuid()
+	job := "gui/" + strconv.Itoa(uid) + "/" + ocmobile.LaunchAgentLabel
+	out, err := exec.CommandContext(ctx, "launchctl", "print", job).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return false, msg
+		}
+		return false, err.Error()
+	}
+	s := string(out)
+	if strings.Contains(s, "state = running") || strings.Contains(s, "state = waiting") {
+		return true, "ok"
+	}
+	return false, "not running"
+}
+
+func (s launchdService) Remove(ctx context.Context) {
+	uid := os.Getuid()
+	job := "gui/" + strconv.Itoa(uid) + "/" + ocmobile.LaunchAgentLabel
+	_ = exec.CommandContext(ctx, "launchctl", "bootout", job).Run()
+
+	plistPath, err := s.DefinitionPath()
+	if err == nil {
+		_ = os.Remove(plistPath)
+	}
+}
+
+type systemdService struct{}
+
+func (systemdService) Manager() string { return "systemd" }
+func (systemdService) Label() string   { return ocmobile.SystemdUnitName }
+func (systemdService) Kind() string    { return "systemd user unit" }
+
+func (systemdService) DefinitionPath() (string, error) {
+	return ocmobile.SystemdUnitPath()
+}
+
+func (systemdService) Render(binPath string, configDir string) ([]byte, error) {
+	stdout, stderr := serviceStdio(configDir)
+	return systemd.RenderUnit(systemd.UnitOptions{
+		Description:     "OpenCode Pocket agent (oc-pocket)",
+		Program:         binPath,
+		ProgramArgs:     []string{"agent", "--config-dir", configDir},
+		EnvironmentFile: agentEnvPath(configDir),
+		StdoutPath:      stdout,
+		StderrPath:      stderr,
+		Restart:         "always",
+		RestartSec:      2 * time.Second,
+	})
+}
+
+// agentEnvPath is the environment file the systemd unit reads. It lives outside the unit so
+// the unit stays the same whatever PATH setup (or doctor) runs with.
+func agentEnvPath(configDir string) string {
+	return filepath.Join(configDir, "agent.env")
+}
+
+// writeEnvironment records the current PATH in the agent's environment file, unless the file
+// already exists. The user manager starts services with a minimal PATH; OpenCode needs the
+// tools the user has on theirs (git, language servers, ...). Later edits to the file are kept.
+func (systemdService) writeEnvironment(configDir string) error {
+	path := agentEnvPath(configDir)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	env := map[string]string{}
+	if p := os.Getenv("PATH"); p != "" {
+		env["PATH"] = p
+	}
+	b, err := systemd.RenderEnvironmentFile(env)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+func (systemdService) Install(ctx context.Context, unitPath string) error {
+	if err := systemctl(ctx, "daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl(ctx, "enable", ocmobile.SystemdUnitName); err != nil {
+		return err
+	}
+	return systemctl(ctx, "restart", ocmobile.SystemdUnitName)
+}
+
+func (systemdService) Restart(ctx context.Context) error {
+	return systemctl(ctx, "restart", ocmobile.SystemdUnitName)
+}
+
+func (systemdService) Status(ctx context.Context) (bool, string) {
+	// is-active exits non-zero for anything but "active" and still prints the state.
+	out, err := exec.CommandContext(ctx, "systemctl", "--user", "is-active", ocmobile.SystemdUnitName).CombinedOutput()
+	state := strings.TrimSpace(string(out))
+	switch {
+	case state == "active" || state == "activating" || state == "reloading":
+		return true, "ok"
+	case state != "":
+		return false, state
+	case err != nil:
+		return false, err.Error()
+	}
+	return false, "not running"
+}
+
+func (s systemdService) Remove(ctx context.Context) {
+	_ = systemctl(ctx, "disable", "--now", ocmobile.SystemdUnitName)
+	unitPath, err := s.DefinitionPath()
+	if err == nil {
+		_ = os.Remove(unitPath)
+	}
+	_ = systemctl(ctx, "daemon-reload")
+}
+
+// lingerHint explains how to keep the agent running after logout, or returns "" if lingering
+// is already enabled or cannot be checked.
+func (systemdService) lingerHint(ctx context.Context) string {
+	out, err := exec.CommandContext(ctx, "loginctl", "show-user", strconv.Itoa(os.Getuid()), "--property=Linger", "--value").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "no" {
+		return ""
+	}
+	return "Note: systemd stops user services when you log out. To keep the agent running (e.g. on a VM you reach over SSH), run: loginctl enable-linger " + os.Getenv("USER")
+}
+
+func systemctl(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, "systemctl", append([]string{"--user"}, args...)...).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if errors.Is(err, exec.ErrNotFound) {
+			msg = "systemctl not found; is this a systemd system?"
+		}
+		return fmt.Errorf("systemctl --user %s failed: %w: %s", strings.Join(args, " "), err, msg)
+	}
+	return nil
+}